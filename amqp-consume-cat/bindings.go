@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+import (
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+// QueueDeclaration holds the options used to declare a binding's queue
+type QueueDeclaration struct {
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       amqp.Table
+}
+
+// ExchangeDeclaration holds the options used to declare a binding's exchange
+type ExchangeDeclaration struct {
+	Type       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Args       amqp.Table
+}
+
+// bindingSpec is a single entry in a binding spec file
+type bindingSpec struct {
+	Exchange struct {
+		Name       string                 `json:"name"`
+		Declare    bool                   `json:"declare"`
+		Type       string                 `json:"type"`
+		Durable    bool                   `json:"durable"`
+		AutoDelete bool                   `json:"auto_delete"`
+		Internal   bool                   `json:"internal"`
+		Arguments  map[string]interface{} `json:"arguments"`
+	} `json:"exchange"`
+	Queue struct {
+		Name       string                 `json:"name"`
+		Declare    bool                   `json:"declare"`
+		Durable    bool                   `json:"durable"`
+		AutoDelete bool                   `json:"auto_delete"`
+		Exclusive  bool                   `json:"exclusive"`
+		Arguments  map[string]interface{} `json:"arguments"`
+	} `json:"queue"`
+	RoutingKey string                 `json:"routing_key"`
+	Arguments  map[string]interface{} `json:"arguments"`
+	NoWait     bool                   `json:"no_wait"`
+}
+
+// LoadQueueBindings reads bindings from a JSON spec file, which allows the
+// queue and exchange to be declared and binding arguments to be given, e.g.
+//
+//	[{
+//	  "exchange": {"name": "events", "declare": true, "type": "headers", "durable": true},
+//	  "queue": {"name": "audit", "declare": true, "durable": true,
+//	            "arguments": {"x-message-ttl": 60000, "x-queue-type": "quorum"}},
+//	  "routing_key": "",
+//	  "arguments": {"x-match": "all", "tenant": "acme"}
+//	}]
+func LoadQueueBindings(filename string) (QueueBindings, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// numbers are kept exact so that integer arguments such as x-message-ttl
+	// are not sent to the broker as doubles
+	var specs []bindingSpec
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&specs); err != nil {
+		return nil, err
+	}
+
+	var bindings QueueBindings
+	for i, spec := range specs {
+		if len(spec.Queue.Name) == 0 && !spec.Queue.Declare {
+			return nil, fmt.Errorf("binding %d: a queue name is required unless the queue is declared", i+1)
+		}
+		if spec.Exchange.Declare && len(spec.Exchange.Type) == 0 {
+			return nil, fmt.Errorf("binding %d: an exchange type is required to declare the exchange", i+1)
+		}
+
+		binding := &QueueBinding{
+			Exchange:   spec.Exchange.Name,
+			QueueName:  spec.Queue.Name,
+			RoutingKey: spec.RoutingKey,
+			parts:      []string{spec.Exchange.Name, spec.Queue.Name, spec.RoutingKey},
+			NoWait:     spec.NoWait,
+			Args:       amqptools.TableFromJSON(spec.Arguments),
+		}
+		if spec.Exchange.Declare {
+			binding.DeclareExchange = &ExchangeDeclaration{
+				Type:       spec.Exchange.Type,
+				Durable:    spec.Exchange.Durable,
+				AutoDelete: spec.Exchange.AutoDelete,
+				Internal:   spec.Exchange.Internal,
+				Args:       amqptools.TableFromJSON(spec.Exchange.Arguments),
+			}
+		}
+		if spec.Queue.Declare {
+			binding.DeclareQueue = &QueueDeclaration{
+				Durable:    spec.Queue.Durable,
+				AutoDelete: spec.Queue.AutoDelete,
+				Exclusive:  spec.Queue.Exclusive,
+				Args:       amqptools.TableFromJSON(spec.Queue.Arguments),
+			}
+		}
+		bindings = append(bindings, binding)
+	}
+
+	if len(bindings) == 0 {
+		return nil, errors.New("no bindings found")
+	}
+	return bindings, nil
+}
+
+// declare declares the binding's exchange and queue, where asked to, and then
+// binds the queue.  A queue declared without a name is given one by the
+// broker, which is recorded in the binding.
+func (qb *QueueBinding) declare(channel *amqp.Channel) error {
+	if qb.queueFrom != nil {
+		qb.QueueName = qb.queueFrom.QueueName
+		qb.parts[1] = qb.QueueName
+	}
+
+	if d := qb.DeclareExchange; d != nil {
+		err := channel.ExchangeDeclare(qb.Exchange, d.Type, d.Durable, d.AutoDelete, d.Internal, false, d.Args)
+		if err != nil {
+			return fmt.Errorf("exchange.declare %s: %s", qb.Exchange, err)
+		}
+	}
+
+	if d := qb.DeclareQueue; d != nil {
+		queue, err := channel.QueueDeclare(qb.QueueName, d.Durable, d.AutoDelete, d.Exclusive, false, d.Args)
+		if err != nil {
+			return fmt.Errorf("queue.declare %s: %s", qb.QueueName, err)
+		}
+		qb.QueueName = queue.Name
+		qb.parts[1] = queue.Name
+	}
+
+	return channel.QueueBind(qb.QueueName, qb.RoutingKey, qb.Exchange, qb.NoWait, qb.Args)
+}
+
+// deleteTemporaryQueues deletes the exclusive queues declared for bindings.
+// The broker would delete them anyway once the connection closes, but this
+// way they are gone as soon as we are done with them.
+func deleteTemporaryQueues(channel *amqp.Channel, bindings QueueBindings, debugger amqptools.Debugger) {
+	for _, binding := range bindings {
+		if binding.DeclareQueue == nil || !binding.DeclareQueue.Exclusive {
+			continue
+		}
+		_, err := channel.QueueDelete(binding.QueueName, false, false, false)
+		if !debugger.WithError(err, "channel.queuedelete ", err) {
+			debugger.Print("Deleted temporary queue", binding.QueueName)
+		}
+	}
+}
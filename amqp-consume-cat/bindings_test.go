@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func writeBindings(t *testing.T, spec string) string {
+	dir, err := ioutil.TempDir("", "consume-cat-bindings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "bindings.json")
+	if err = ioutil.WriteFile(path, []byte(spec), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadQueueBindings(t *testing.T) {
+	path := writeBindings(t, `[{
+	  "exchange": {"name": "events", "declare": true, "type": "headers", "durable": true},
+	  "queue": {"name": "audit", "declare": true, "durable": true,
+	            "arguments": {"x-message-ttl": 60000, "x-queue-type": "quorum", "ratio": 0.5}},
+	  "routing_key": "",
+	  "arguments": {"x-match": "all", "tenant": "acme", "nested": {"limits": [1, 2]}}
+	}, {
+	  "exchange": {"name": "events"},
+	  "queue": {"name": "audit"},
+	  "routing_key": "order.#"
+	}]`)
+
+	bindings, err := LoadQueueBindings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 2 {
+		t.Fatalf("expected 2 bindings, got %v", bindings)
+	}
+
+	first := bindings[0]
+	if first.Exchange != "events" || first.QueueName != "audit" || first.String() != "events/audit/_" {
+		t.Errorf("unexpected binding %s", first)
+	}
+	if first.DeclareExchange == nil || first.DeclareExchange.Type != "headers" || !first.DeclareExchange.Durable {
+		t.Errorf("unexpected exchange declaration %+v", first.DeclareExchange)
+	}
+	if first.DeclareQueue == nil || !first.DeclareQueue.Durable {
+		t.Fatalf("unexpected queue declaration %+v", first.DeclareQueue)
+	}
+
+	// integers must reach the broker as integers rather than doubles
+	args := first.DeclareQueue.Args
+	if ttl, ok := args["x-message-ttl"].(int64); !ok || ttl != 60000 {
+		t.Errorf("expected an integer x-message-ttl, got %#v", args["x-message-ttl"])
+	}
+	if ratio, ok := args["ratio"].(float64); !ok || ratio != 0.5 {
+		t.Errorf("expected a float ratio, got %#v", args["ratio"])
+	}
+	if err = first.Args.Validate(); err != nil {
+		t.Errorf("expected binding arguments an amqp.Table accepts: %s", err)
+	}
+	limits := first.Args["nested"].(amqp.Table)["limits"].([]interface{})
+	if limit, ok := limits[0].(int64); !ok || limit != 1 {
+		t.Errorf("expected nested integers, got %#v", limits)
+	}
+
+	second := bindings[1]
+	if second.RoutingKey != "order.#" || second.DeclareQueue != nil || second.DeclareExchange != nil {
+		t.Errorf("expected a plain binding, got %+v", second)
+	}
+}
+
+func TestLoadQueueBindingsErrors(t *testing.T) {
+	for spec, reason := range map[string]string{
+		`[]`: "no bindings",
+		`[{"exchange": {"name": "events"}, "routing_key": "#"}]`:                                          "a missing queue name",
+		`[{"exchange": {"name": "events", "declare": true}, "queue": {"name": "q"}, "routing_key": "#"}]`: "an exchange declared without a type",
+		`{"not": "a list"}`: "a file that is not a list",
+	} {
+		if _, err := LoadQueueBindings(writeBindings(t, spec)); err == nil {
+			t.Errorf("expected an error for %s", reason)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+var (
+	prefetchCount    = flag.Int("prefetch-count", 10, "Number of unacknowledged messages the broker may send ahead")
+	prefetchSize     = flag.Int("prefetch-size", 0, "Number of bytes of unacknowledged messages the broker may send ahead (0 for no limit)")
+	exclusiveConsume = flag.Bool("exclusive", true, "Consume exclusively, so that consuming fails if the queue already has consumers")
+	noLocalConsume   = flag.Bool("no-local", true, "Ask the broker not to deliver messages published on this connection")
+	consumerPriority = flag.Int("consumer-priority", 0, "Consumer priority, passed as the x-priority consumer argument (0 to leave unset)")
+
+	consumerArguments ConsumerArgs
+)
+
+func init() {
+	flag.Var(&consumerArguments, "consumer-arg", "Consumer argument specified as \"name=value\". Integer and true/false values are sent as such, anything else as a string")
+}
+
+// ConsumerArgs is the table of arguments passed with basic.consume
+type ConsumerArgs amqp.Table
+
+func (ca *ConsumerArgs) String() string {
+	return fmt.Sprint(map[string]interface{}(*ca))
+}
+
+// Set is used by flag to assign contents to a custom type
+func (ca *ConsumerArgs) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return errors.New("consumer argument requires a name and a value, e.g. \"x-cancel-on-ha-failover=true\"")
+	}
+	if *ca == nil {
+		*ca = make(ConsumerArgs)
+	}
+	(*ca)[parts[0]] = argumentValue(parts[1])
+	return nil
+}
+
+func argumentValue(value string) interface{} {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n
+	}
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+	return value
+}
+
+// consumerTable returns the arguments to consume with, including the consumer
+// priority
+func consumerTable() amqp.Table {
+	if len(consumerArguments) == 0 && *consumerPriority == 0 {
+		return nil
+	}
+	table := amqp.Table{}
+	for name, value := range consumerArguments {
+		table[name] = value
+	}
+	if *consumerPriority != 0 {
+		table["x-priority"] = int32(*consumerPriority)
+	}
+	return table
+}
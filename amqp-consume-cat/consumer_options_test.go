@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+func TestConsumerArgsSet(t *testing.T) {
+	var args ConsumerArgs
+	for _, value := range []string{"x-stream-offset=5000", "x-cancel-on-ha-failover=true", "x-ready=false",
+		"x-stream-offset-spec=first", "x-ratio=0.5", "x-empty=", "x-query=a=b"} {
+		if err := args.Set(value); err != nil {
+			t.Errorf("unexpected error for '%s': %s", value, err)
+		}
+	}
+
+	expected := ConsumerArgs{
+		"x-stream-offset":         int64(5000),
+		"x-cancel-on-ha-failover": true,
+		"x-ready":                 false,
+		"x-stream-offset-spec":    "first",
+		"x-ratio":                 "0.5",
+		"x-empty":                 "",
+		"x-query":                 "a=b",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	for _, value := range []string{"x-priority", "=10"} {
+		if err := args.Set(value); err == nil {
+			t.Errorf("expected '%s' to be refused", value)
+		}
+	}
+}
+
+func TestConsumerTable(t *testing.T) {
+	savedArgs, savedPriority := consumerArguments, *consumerPriority
+	defer func() { consumerArguments, *consumerPriority = savedArgs, savedPriority }()
+
+	for _, test := range []struct {
+		args     ConsumerArgs
+		priority int
+		expected amqp.Table
+	}{
+		{nil, 0, nil},
+		{nil, 5, amqp.Table{"x-priority": int32(5)}},
+		{nil, -1, amqp.Table{"x-priority": int32(-1)}},
+		{ConsumerArgs{"x-stream-offset": int64(10)}, 0, amqp.Table{"x-stream-offset": int64(10)}},
+		// -consumer-priority wins over an x-priority given as an argument
+		{ConsumerArgs{"x-priority": int64(1), "x-ready": true}, 5, amqp.Table{"x-priority": int32(5), "x-ready": true}},
+	} {
+		consumerArguments, *consumerPriority = test.args, test.priority
+		table := consumerTable()
+		if !reflect.DeepEqual(table, test.expected) {
+			t.Errorf("%+v: expected %#v, got %#v", test, test.expected, table)
+		}
+		if err := table.Validate(); err != nil {
+			t.Errorf("%+v: %s", test, err)
+		}
+		if len(test.args) > 0 && test.priority != 0 && test.args["x-priority"] != int64(1) {
+			t.Errorf("expected the arguments given to be left alone, got %v", test.args)
+		}
+	}
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"strings"
@@ -18,10 +17,20 @@ import (
 
 var (
 	outDirFlag        = flag.String("d", "", "Output directory for messages. If not specified, output will go to stdout.")
-	continuousConsume = flag.Bool("continuous", false, "If true, consume indefinitely ; otherwise, exit when queue is emptied.")
+	pathTemplate      = flag.String("path-template", amqptools.DefaultPathTemplate, "Go template for the directory, under -d, that each message is written to, e.g. '{{.RoutingKey}}/{{.Timestamp.Format \"2006-01-02\"}}/{{.MessageId}}'. Fields of the delivery may be used directly, along with .Data, .JSON and .SHA1")
+	extractBody       = flag.Bool("extract-body", false, "With -d, also write each message's raw body beside message.json, with an extension taken from its content type")
+	bodyFormat        = flag.String("body-format", "auto", "How to show message bodies: auto, string, json, base64 or hex. auto embeds JSON bodies as JSON, keeps text as text and base64 encodes anything else, after undoing any gzip or deflate content encoding")
+	continuousConsume = flag.Bool("continuous", false, "If true, consume indefinitely ; otherwise, drain each queue of the messages it held at start and exit.")
+	outputFormat      = flag.String("format", "json", "How to print messages to stdout: json, compact for one line per message, csv or tsv with -columns, or a Go template over the delivery, e.g. '{{.RoutingKey}} {{.RenderedBody}}'. Output is colored when stdout is a terminal")
+	columns           = flag.String("columns", amqptools.DefaultColumns, "Comma separated columns for -format csv|tsv: properties such as RoutingKey, headers.<name>, body.<json path> such as body.items.0.sku, body, size (in bytes) or age (in seconds)")
 	prettyPrint       = flag.Bool("pretty", false, "Print more human-readable JSON. Should not be used if piping into another application.")
-	keepMessages      = flag.Bool("keep", false, "If set to false, messages will be purged from the queue after reading. Only applies for continuous: false")
+	keepMessages      = flag.Bool("keep", false, "If set to false, messages will be purged from the queue after reading. Short for -disposition requeue. With continuous: false, each message is read exactly once and all of them are requeued at the end")
+	firehosePattern   = flag.String("firehose", "", "Tap RabbitMQ's firehose tracer for events matching this pattern, e.g. \"publish.#\", and unwrap each into the message it traced. Implies -continuous")
+	pluginCommand     = flag.String("plugin", "", "Long-running command to pipe each delivery through as a line of JSON. It must answer each line with {\"messages\": [...]}, {\"drop\": true} or {\"error\": \"reason\"}. Also applies to messages read back with -read")
+	sinkURI           = flag.String("sink", "", "Where to write messages, as a URI: stdout:, dir:<path>, file:<path>[?max-size=100M&max-messages=N&max-age=1h&compress=gzip|zstd&sync=false], exec:<command>[?requeue-code=75&timeout=30s&stdin=json], http(s)://..., sqlite:<path> or amqp(s)://...[?exchange=&routing-key=]. Messages are only acked once the sink has written them. Overrides -d")
 	consumerTag       string
+	plugin            *amqptools.Plugin
+	sink              amqptools.Sink
 )
 
 // QueueBinding is used for establishing binding list
@@ -33,6 +42,13 @@ type QueueBinding struct {
 
 	NoWait bool
 	Args   amqp.Table
+
+	DeclareQueue    *QueueDeclaration
+	DeclareExchange *ExchangeDeclaration
+
+	// queueFrom is a binding whose queue is shared, when that queue is
+	// server-named
+	queueFrom *QueueBinding
 }
 
 // QueueBindings is simply an array of QueueBinding structs
@@ -77,8 +93,9 @@ func (qb *QueueBindings) Set(value string) error {
 }
 
 type consumerChannel struct {
-	deliveries <-chan amqp.Delivery
-	binding    *QueueBinding
+	deliveries  <-chan amqp.Delivery
+	binding     *QueueBinding
+	consumerTag string
 }
 
 // ConsumeForBindings establishes a consumer connection and passes the deliveries into a provided channel
@@ -100,13 +117,18 @@ func ConsumeForBindings(connectionUri string, bindings QueueBindings, deliveries
 	}
 	debugger.Print("Channel opened")
 
-	// set qos
-	qosValue := 10
-	err = channel.Qos(qosValue, 0, false)
+	// set qos, letting at least a whole -ack-batch through, since a batch is
+	// only settled once it is full and the broker stops delivering once
+	// prefetch-count messages are unacked
+	prefetch := *prefetchCount
+	if prefetch > 0 && *ackBatch > prefetch {
+		prefetch = *ackBatch
+	}
+	err = channel.Qos(prefetch, *prefetchSize, false)
 	if debugger.WithError(err, "channel.qos: ", err) {
 		os.Exit(3)
 	}
-	debugger.Print(fmt.Sprintf("Channel QOS set to %d", qosValue))
+	debugger.Print(fmt.Sprintf("Channel QOS set to %d messages, %d bytes", prefetch, *prefetchSize))
 
 	var consumerChannels []consumerChannel
 
@@ -115,142 +137,219 @@ func ConsumeForBindings(connectionUri string, bindings QueueBindings, deliveries
 		os.Exit(4)
 	}
 
-	consumerTag = string(uuidBytes)
+	consumerTag = strings.TrimSpace(string(uuidBytes))
+
+	consumedQueues := make(map[string]bool)
 
 	for _, binding := range bindings {
-		err = channel.QueueBind(binding.QueueName, binding.RoutingKey, binding.Exchange, false, nil)
-		if debugger.WithError(err, "channel.queuebind ", err) {
+		err = binding.declare(channel)
+		if debugger.WithError(err, "binding.declare ", err) {
 			return
 		}
 
+		// a queue bound with several routing keys is only read once
+		if consumedQueues[binding.QueueName] {
+			continue
+		}
+		consumedQueues[binding.QueueName] = true
+
 		if *continuousConsume {
 			/*
 				autoAck = false (must manually Ack)
-				exclusive = true (so we only try to read from one consumer at a time)
-				noLocal = true (so that if this consumer republishes to the failure queue, it will not pick the messages back up)
-				noWait = true
+				exclusive = -exclusive, true by default (so we only try to read from one consumer at a time)
+				noLocal = -no-local, true by default (RabbitMQ ignores it, but other brokers leave out messages published on this connection)
+				noWait = false (so that a refused consume, e.g. of a queue that already has consumers, is reported here)
+				args = -consumer-arg and -consumer-priority
 			*/
-			consumerChan, err := channel.Consume(binding.QueueName, consumerTag, false, true, true, true, nil)
+			// consumer tags must be unique per channel, so each queue gets its own
+			queueConsumerTag := fmt.Sprintf("%s-%d", consumerTag, len(consumerChannels))
+			consumerChan, err := channel.Consume(binding.QueueName, queueConsumerTag, false,
+				*exclusiveConsume, *noLocalConsume, false, consumerTable())
 			if debugger.WithError(err, "channel.consume ", err) {
 				return
 			}
 
-			consumerChannels = append(consumerChannels, consumerChannel{consumerChan, binding})
+			consumerChannels = append(consumerChannels, consumerChannel{consumerChan, binding, queueConsumerTag})
 		} else {
-			consumerChannels = append(consumerChannels, consumerChannel{nil, binding})
+			consumerChannels = append(consumerChannels, consumerChannel{nil, binding, ""})
 		}
 	}
 
+	limits := newConsumeLimits()
+
 	if *continuousConsume {
-		for {
-			for _, ch := range consumerChannels {
-				select {
-				case delivery := <-ch.deliveries:
-					deliveries <- delivery
-				}
-			}
+		reason := multiplexDeliveries(consumerChannels, queueWeights, limits, deliveries)
+		log.Println("Stopped consuming:", reason)
+
+		// anything received but not yet handed over is requeued by the broker
+		// once the channel closes
+		for _, ch := range consumerChannels {
+			err = channel.Cancel(ch.consumerTag, false)
+			debugger.WithError(err, "channel.cancel ", err)
 		}
+		waitForHandlers(deliveries)
+		err = acks.Flush()
+		debugger.WithError(err, "Unable to settle batched messages: ", err)
+
+		deleteTemporaryQueues(channel, bindings, debugger)
 	} else {
+		var summaries []drainSummary
+		var lastDeliveryTag uint64
 		for _, ch := range consumerChannels {
-			binding := ch.binding
-			debugger.Print("Getting messages from queue", binding.QueueName)
-			for {
-				delivery, ok, err := channel.Get(binding.QueueName, false)
-				if debugger.WithError(err, "channel.get ", err) {
-					os.Exit(5)
-				}
-				if ok == false {
-					deliveries <- nil
-				} else {
-					deliveries <- delivery
-				}
+			if reason := limits.Reached(); len(reason) > 0 {
+				log.Println("Stopped draining:", reason)
+				break
+			}
+			summary := drainQueue(channel, ch.binding.QueueName, limits, deliveries, debugger)
+			summaries = append(summaries, summary)
+			if summary.lastDeliveryTag > 0 {
+				lastDeliveryTag = summary.lastDeliveryTag
+			}
+		}
+		waitForHandlers(deliveries)
+		err = acks.Flush()
+		debugger.WithError(err, "Unable to settle batched messages: ", err)
+
+		for _, summary := range summaries {
+			log.Println(summary)
+		}
+		if browsing() && lastDeliveryTag > 0 {
+			// everything browsed has been held unacked, so put it all back
+			err = channel.Nack(lastDeliveryTag, true, true)
+			if !debugger.WithError(err, "channel.nack ", err) {
+				log.Println("Requeued all browsed messages")
 			}
 		}
 	}
 }
 
-// HandleDelivery handles the amqp.Delivery object and either prints it out or
-// writes it to a files
+// drainSummary records how much of a queue was drained
+type drainSummary struct {
+	QueueName string
+	Expected  int
+	Read      int
+
+	lastDeliveryTag uint64
+}
+
+func (ds drainSummary) String() string {
+	return fmt.Sprintf("%s: drained %d of %d message(s)", ds.QueueName, ds.Read, ds.Expected)
+}
+
+// queueGetter is the part of an *amqp.Channel that draining a queue uses
+type queueGetter interface {
+	QueueInspect(name string) (amqp.Queue, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+}
+
+// drainQueue gets as many messages from a queue as it held when draining
+// began, so that messages published in the meantime can not keep the drain
+// running forever, and stops early if the queue runs dry or a limit is reached
+func drainQueue(channel queueGetter, queueName string, limits *consumeLimits, deliveries chan interface{}, debugger amqptools.Debugger) drainSummary {
+	// QueueInspect is a passive queue declare
+	queue, err := channel.QueueInspect(queueName)
+	if debugger.WithError(err, "channel.queueinspect ", err) {
+		os.Exit(5)
+	}
+
+	summary := drainSummary{QueueName: queueName, Expected: queue.Messages}
+	debugger.Print(fmt.Sprintf("Getting %d message(s) from queue %s", queue.Messages, queueName))
+
+	for summary.Read < summary.Expected && len(limits.Reached()) == 0 {
+		delivery, ok, err := channel.Get(queueName, false)
+		if debugger.WithError(err, "channel.get ", err) {
+			os.Exit(5)
+		}
+		if !ok {
+			break
+		}
+		limits.Count(delivery)
+		deliveries <- delivery
+		summary.Read++
+		summary.lastDeliveryTag = delivery.DeliveryTag
+	}
+	return summary
+}
+
+// browsing reports whether messages are being read without being removed
+// from their queues.  Browsed messages are held unacked until every queue has
+// been read, rather than being requeued one at a time where the next
+// channel.Get would pick them straight back up, so that each message is seen
+// exactly once.
+func browsing() bool {
+	return requeueing() && !*continuousConsume
+}
+
+// requeueDelivery puts a message that could not be handled back on its
+// queue, unless it is being held until the end of a browse or has failed too
+// often and is parked instead
+func requeueDelivery(delivery amqp.Delivery, reason error) error {
+	if parked, err := parkIfPoisoned(delivery, reason); parked {
+		return err
+	}
+	acks.Handled(delivery)
+	if browsing() {
+		return nil
+	}
+	return delivery.Reject(true)
+}
+
+// HandleDelivery handles the amqp.Delivery object and writes it to the sink,
+// acking it only once the sink has written it
 func HandleDelivery(delivery amqp.Delivery, debugger amqptools.Debugger) {
-	addlData := make(map[string]interface{})
-	addlData["BodyAsString"] = string(delivery.Body)
 	deliveryPlus := &amqptools.DeliveryPlus{
 		delivery,
-		addlData,
+		make(map[string]interface{}),
 	}
 
-	var jsonBytes []byte
 	var err error
 
+	if len(*firehosePattern) > 0 {
+		traced, err := amqptools.DecodeFirehose(delivery)
+		if !debugger.WithError(err, "Unable to decode firehose event: ", err) {
+			deliveryPlus = traced
+		}
+	}
+
 	// necessary because otherwise it isn't unmarshalable
 	deliveryPlus.RawDelivery.Acknowledger = nil
 
-	if *prettyPrint {
-		jsonBytes, err = json.MarshalIndent(deliveryPlus, "", "\t")
-		if debugger.WithError(err, "Unable to marshal delivery into JSON.") {
+	outputs := []*amqptools.DeliveryPlus{deliveryPlus}
+
+	if plugin != nil {
+		outputs, err = plugin.Process(deliveryPlus)
+		if _, ok := err.(*amqptools.PluginError); ok {
+			debugger.Print(fmt.Sprintf("Requeueing message '%s': %s", delivery.MessageId, err))
+			err = requeueDelivery(delivery, err)
+			debugger.WithError(err, "Unable to Reject a message")
 			return
 		}
-	} else {
-		jsonBytes, err = json.Marshal(deliveryPlus)
-		if debugger.WithError(err, "Unable to marshal delivery into JSON.") {
-			return
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "FATAL:", err)
+			os.Exit(6)
 		}
 	}
 
-	if len(*outDirFlag) == 0 {
-		fmt.Println(fmt.Sprintf("%s", string(jsonBytes)))
-	} else {
-		var folderName string
-		if len(delivery.MessageId) > 0 {
-			folderName = delivery.MessageId
-		} else {
-			h := sha1.New()
-			fmt.Fprintf(h, "%s", jsonBytes)
-			folderName = fmt.Sprintf("%x", h.Sum(nil))
-		}
-
-		var exchangeStr string
-		if len(delivery.Exchange) == 0 {
-			exchangeStr = "_"
-		} else {
-			exchangeStr = delivery.Exchange
-		}
-
-		pathParts := []string{
-			strings.TrimRight(*outDirFlag, string(os.PathSeparator)),
-			exchangeStr,
-			folderName,
-		}
-		fullPath := strings.Join(pathParts, string(os.PathSeparator))
-
-		fileName := fmt.Sprintf("%s%smessage.json", fullPath, string(os.PathSeparator))
+	for _, output := range outputs {
+		err = amqptools.RenderBody(output, *bodyFormat)
+		debugger.WithError(err, "Rendering body: ", err)
 
-		err = os.MkdirAll(fullPath, os.ModeDir|os.ModePerm)
-		if debugger.WithError(err, fmt.Sprintf("Unable to create output directory '%s'.", fullPath)) {
+		err = sink.Write(output)
+		if rejectErr, ok := err.(*amqptools.RejectError); ok {
+			log.Printf("Rejecting message '%s': %s", delivery.MessageId, rejectErr)
+			err = rejectDelivery(delivery)
+			debugger.WithError(err, "Unable to Reject a message")
 			return
 		}
-
-		file, err := os.Create(fileName)
-		if debugger.WithError(err, fmt.Sprintf("Unable to create file '%s'.", fileName)) {
+		if err != nil {
+			log.Printf("Unable to write message '%s', requeueing it: %s", delivery.MessageId, err)
+			err = requeueDelivery(delivery, err)
+			debugger.WithError(err, "Unable to Reject a message")
 			return
 		}
-
-		_, err = file.Write(jsonBytes)
-		if debugger.WithError(err, fmt.Sprintf("Unable to write data into buffer for '%s'.", fileName)) {
-			return
-		}
-		debugger.Print(fmt.Sprintf("Data written to %s", fileName))
-
-		err = file.Close()
-		debugger.WithError(err, fmt.Sprintf("Unable to close file '%s'.", fileName))
 	}
 
-	if *keepMessages {
-		err = delivery.Reject(true)
-	} else {
-		err = delivery.Ack(false)
-	}
-	if debugger.WithError(err, "Unable to Ack a message") {
-		return
-	}
+	failures.Forget(delivery)
+	err = acks.Dispose(delivery)
+	debugger.WithError(err, "Unable to settle a message: ", err)
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+// fakeQueue reports depth messages when inspected, and then hands out
+// messages until it has given available of them
+type fakeQueue struct {
+	depth     int
+	available int
+	got       int
+}
+
+func (q *fakeQueue) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{Name: name, Messages: q.depth}, nil
+}
+
+func (q *fakeQueue) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	if q.got >= q.available {
+		return amqp.Delivery{}, false, nil
+	}
+	q.got++
+	return amqp.Delivery{DeliveryTag: uint64(q.got), Body: []byte("x")}, true, nil
+}
+
+func drained(queue *fakeQueue, limits *consumeLimits) (drainSummary, int) {
+	deliveries := make(chan interface{}, 100)
+	summary := drainQueue(queue, "orders", limits, deliveries, amqptools.Debugger{})
+	return summary, len(deliveries)
+}
+
+func TestDrainQueueStopsAtStartingDepth(t *testing.T) {
+	// messages published during the drain are left for next time
+	summary, sent := drained(&fakeQueue{depth: 3, available: 10}, &consumeLimits{})
+	if summary.Read != 3 || summary.Expected != 3 || sent != 3 || summary.lastDeliveryTag != 3 {
+		t.Errorf("expected to drain 3 messages, got %+v with %d sent", summary, sent)
+	}
+	if summary.String() != "orders: drained 3 of 3 message(s)" {
+		t.Errorf("unexpected summary '%s'", summary)
+	}
+}
+
+func TestDrainQueueStopsWhenDry(t *testing.T) {
+	// another consumer took some of the messages
+	summary, sent := drained(&fakeQueue{depth: 5, available: 2}, &consumeLimits{})
+	if summary.Read != 2 || summary.Expected != 5 || sent != 2 {
+		t.Errorf("expected to stop after 2 messages, got %+v with %d sent", summary, sent)
+	}
+}
+
+func TestDrainQueueStopsAtLimit(t *testing.T) {
+	limits := &consumeLimits{MaxMessages: 4}
+	summary, sent := drained(&fakeQueue{depth: 10, available: 10}, limits)
+	if summary.Read != 4 || sent != 4 {
+		t.Errorf("expected to stop after 4 messages, got %+v with %d sent", summary, sent)
+	}
+
+	// a limit reached on one queue stops the drain of the next before it
+	// gets anything
+	summary, sent = drained(&fakeQueue{depth: 10, available: 10}, limits)
+	if summary.Read != 0 || sent != 0 {
+		t.Errorf("expected nothing after the limit, got %+v with %d sent", summary, sent)
+	}
+}
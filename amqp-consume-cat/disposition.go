@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+var (
+	disposition = flag.String("disposition", "ack", "What to do with each message once it is written: ack, requeue (basic.reject, requeued), reject (basic.reject, not requeued, so dead-lettered through the queue's DLX if it has one) or nack (basic.nack, requeued). -keep is short for requeue")
+	ackBatch    = flag.Int("ack-batch", 0, "With ack or nack, settle messages in batches of this many with a single multiple=true ack or nack (0 to settle each message on its own). -prefetch-count is raised to at least this many")
+	ackInterval = flag.Duration("ack-interval", 0, "With ack or nack, settle any batched messages at least this often, e.g. 500ms (0 to wait for a full batch)")
+
+	acks *ackBatcher
+)
+
+// checkDisposition validates the disposition flags, folding -keep into
+// -disposition
+func checkDisposition() error {
+	if *keepMessages {
+		if *disposition != "ack" && *disposition != "requeue" {
+			return errors.New("-keep can not be combined with -disposition " + *disposition)
+		}
+		*disposition = "requeue"
+	}
+
+	switch *disposition {
+	case "ack", "nack":
+	case "requeue", "reject":
+		if *ackBatch > 0 || *ackInterval > 0 {
+			return errors.New("basic.reject settles one message at a time, so -ack-batch and -ack-interval only apply to ack and nack")
+		}
+	default:
+		return errors.New("unknown disposition '" + *disposition + "', expected ack, requeue, reject or nack")
+	}
+	return nil
+}
+
+// requeueing reports whether messages are put back on their queues once they
+// have been read
+func requeueing() bool {
+	return *disposition == "requeue" || *disposition == "nack"
+}
+
+// ackBatcher settles messages with the chosen disposition, batching acks and
+// nacks into multiple=true frames when asked to.  Delivery tags count up from
+// 1 on a channel, but messages from several queues may be handled out of
+// order, so a multiple=true frame is only ever sent for a tag below which
+// every message has been handled; anything left over is settled on its own
+// by Flush.
+type ackBatcher struct {
+	mutex sync.Mutex
+
+	// handled records messages above lowestUnhandled that have been handled
+	handled         map[uint64]bool
+	lowestUnhandled uint64
+	pending         map[uint64]amqp.Delivery
+
+	done chan bool
+}
+
+func newAckBatcher() *ackBatcher {
+	b := &ackBatcher{
+		handled:         make(map[uint64]bool),
+		lowestUnhandled: 1,
+		pending:         make(map[uint64]amqp.Delivery),
+		done:            make(chan bool),
+	}
+	if *ackInterval > 0 {
+		go b.tick(*ackInterval)
+	}
+	return b
+}
+
+func (b *ackBatcher) tick(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.mutex.Lock()
+			err := b.settleHandled()
+			b.mutex.Unlock()
+			debugger.WithError(err, "Unable to settle batched messages: ", err)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Handled records that a message has been settled some other way, e.g.
+// requeued after its sink failed
+func (b *ackBatcher) Handled(delivery amqp.Delivery) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.markHandled(delivery.DeliveryTag)
+}
+
+func (b *ackBatcher) markHandled(tag uint64) {
+	b.handled[tag] = true
+	for b.handled[b.lowestUnhandled] {
+		delete(b.handled, b.lowestUnhandled)
+		b.lowestUnhandled++
+	}
+}
+
+// Dispose settles a message with the chosen disposition, or adds it to the
+// batch
+func (b *ackBatcher) Dispose(delivery amqp.Delivery) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.markHandled(delivery.DeliveryTag)
+
+	if browsing() {
+		// held until the drain is over, then requeued all at once
+		return nil
+	}
+
+	batching := *ackBatch > 0 || *ackInterval > 0
+	switch {
+	case *disposition == "requeue":
+		return delivery.Reject(true)
+	case *disposition == "reject":
+		return delivery.Reject(false)
+	case !batching && *disposition == "nack":
+		return delivery.Nack(false, true)
+	case !batching:
+		return delivery.Ack(false)
+	}
+
+	b.pending[delivery.DeliveryTag] = delivery
+	if *ackBatch > 0 && len(b.pending) >= *ackBatch {
+		return b.settleHandled()
+	}
+	return nil
+}
+
+// settleHandled sends a single multiple=true frame for the pending messages
+// below the lowest unhandled one
+func (b *ackBatcher) settleHandled() error {
+	var last amqp.Delivery
+	for tag, delivery := range b.pending {
+		if tag < b.lowestUnhandled {
+			if tag > last.DeliveryTag {
+				last = delivery
+			}
+			delete(b.pending, tag)
+		}
+	}
+	if last.DeliveryTag == 0 {
+		return nil
+	}
+	return settle(last, true)
+}
+
+// Flush settles everything still pending.  It must be called once the last
+// message has been handled and before the channel closes.
+func (b *ackBatcher) Flush() error {
+	close(b.done)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.settleHandled()
+
+	// whatever is left sits above a message that was never handled, so it
+	// has to be settled one message at a time
+	var tags []uint64
+	for tag := range b.pending {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	for _, tag := range tags {
+		if settleErr := settle(b.pending[tag], false); err == nil {
+			err = settleErr
+		}
+		delete(b.pending, tag)
+	}
+	return err
+}
+
+func settle(delivery amqp.Delivery, multiple bool) error {
+	if *disposition == "nack" {
+		return delivery.Nack(multiple, true)
+	}
+	return delivery.Ack(multiple)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// recordingAcknowledger logs each frame a delivery would send to the broker
+type recordingAcknowledger struct {
+	frames []string
+}
+
+func (a *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.frames = append(a.frames, fmt.Sprintf("ack %d multiple=%t", tag, multiple))
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.frames = append(a.frames, fmt.Sprintf("nack %d multiple=%t requeue=%t", tag, multiple, requeue))
+	return nil
+}
+
+func (a *recordingAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.frames = append(a.frames, fmt.Sprintf("reject %d requeue=%t", tag, requeue))
+	return nil
+}
+
+func (a *recordingAcknowledger) delivery(tag uint64) amqp.Delivery {
+	return amqp.Delivery{Acknowledger: a, DeliveryTag: tag}
+}
+
+// withDisposition sets the disposition flags for the length of a test
+func withDisposition(t *testing.T, value string, batch int, interval time.Duration) {
+	savedDisposition, savedBatch, savedInterval := *disposition, *ackBatch, *ackInterval
+	savedKeep, savedContinuous := *keepMessages, *continuousConsume
+	t.Cleanup(func() {
+		*disposition, *ackBatch, *ackInterval = savedDisposition, savedBatch, savedInterval
+		*keepMessages, *continuousConsume = savedKeep, savedContinuous
+	})
+
+	*disposition, *ackBatch, *ackInterval = value, batch, interval
+	*keepMessages = false
+	// requeued messages are settled as they are read, not held for a drain
+	*continuousConsume = true
+}
+
+func TestCheckDisposition(t *testing.T) {
+	for _, test := range []struct {
+		disposition string
+		keep        bool
+		batch       int
+		interval    time.Duration
+		expected    string
+		valid       bool
+	}{
+		{"ack", false, 100, time.Second, "ack", true},
+		{"nack", false, 100, 0, "nack", true},
+		{"reject", false, 0, 0, "reject", true},
+		{"ack", true, 0, 0, "requeue", true},
+		{"requeue", true, 0, 0, "requeue", true},
+		{"reject", true, 0, 0, "reject", false},
+		{"requeue", false, 100, 0, "requeue", false},
+		{"reject", false, 0, time.Second, "reject", false},
+		{"drop", false, 0, 0, "drop", false},
+	} {
+		withDisposition(t, test.disposition, test.batch, test.interval)
+		*keepMessages = test.keep
+
+		err := checkDisposition()
+		if test.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %s", test, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%+v: expected an error", test)
+		}
+		if *disposition != test.expected {
+			t.Errorf("%+v: expected disposition %s, got %s", test, test.expected, *disposition)
+		}
+	}
+}
+
+func TestAckBatcherUnbatched(t *testing.T) {
+	for disposition, expected := range map[string]string{
+		"ack":     "ack 1 multiple=false",
+		"nack":    "nack 1 multiple=false requeue=true",
+		"requeue": "reject 1 requeue=true",
+		"reject":  "reject 1 requeue=false",
+	} {
+		withDisposition(t, disposition, 0, 0)
+		acknowledger := &recordingAcknowledger{}
+
+		b := newAckBatcher()
+		if err := b.Dispose(acknowledger.delivery(1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(acknowledger.frames, []string{expected}) {
+			t.Errorf("%s: expected %q, got %q", disposition, expected, acknowledger.frames)
+		}
+	}
+}
+
+func TestAckBatcherOutOfOrder(t *testing.T) {
+	withDisposition(t, "ack", 3, 0)
+	acknowledger := &recordingAcknowledger{}
+	b := newAckBatcher()
+
+	// messages from two queues interleave, and tag 3 is still being written
+	// when the batch fills up, so only tags up to 2 can be acked together
+	for _, tag := range []uint64{2, 1, 4} {
+		if err := b.Dispose(acknowledger.delivery(tag)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"ack 2 multiple=true"}
+	if !reflect.DeepEqual(acknowledger.frames, expected) {
+		t.Fatalf("expected %q, got %q", expected, acknowledger.frames)
+	}
+
+	// tag 5 was requeued after its sink failed, which closes no gap
+	b.Handled(acknowledger.delivery(5))
+	if err := b.Dispose(acknowledger.delivery(6)); err != nil {
+		t.Fatal(err)
+	}
+
+	// tag 3 never finishes, so everything above it is settled on its own
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "ack 4 multiple=false", "ack 6 multiple=false")
+	if !reflect.DeepEqual(acknowledger.frames, expected) {
+		t.Errorf("expected %q, got %q", expected, acknowledger.frames)
+	}
+}
+
+func TestAckBatcherHandledClosesGaps(t *testing.T) {
+	withDisposition(t, "nack", 2, 0)
+	acknowledger := &recordingAcknowledger{}
+	b := newAckBatcher()
+
+	b.Handled(acknowledger.delivery(1))
+	for _, tag := range []uint64{3, 2} {
+		if err := b.Dispose(acknowledger.delivery(tag)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"nack 3 multiple=true requeue=true"}
+	if !reflect.DeepEqual(acknowledger.frames, expected) {
+		t.Errorf("expected %q, got %q", expected, acknowledger.frames)
+	}
+}
+
+func TestAckBatcherInterval(t *testing.T) {
+	withDisposition(t, "ack", 0, 10*time.Millisecond)
+	acknowledger := &recordingAcknowledger{}
+	b := newAckBatcher()
+
+	for _, tag := range []uint64{1, 2} {
+		if err := b.Dispose(acknowledger.delivery(tag)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mutex.Lock()
+		frames := append([]string(nil), acknowledger.frames...)
+		b.mutex.Unlock()
+		if len(frames) > 0 {
+			expected := []string{"ack 2 multiple=true"}
+			if !reflect.DeepEqual(frames, expected) {
+				t.Errorf("expected %q, got %q", expected, frames)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the batch to be settled by the interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(acknowledger.frames) != 1 {
+		t.Errorf("expected nothing left to settle, got %q", acknowledger.frames)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+var (
+	maxMessages = flag.Int("max-messages", 0, "Stop after this many messages (0 for no limit)")
+	maxBytes    = flag.Int64("max-bytes", 0, "Stop once this many bytes of message bodies have been read (0 for no limit)")
+	idleTimeout = flag.Duration("idle-timeout", 0, "Stop once no message has arrived for this long, e.g. \"10s\" (0 for no limit)")
+	runDuration = flag.Duration("duration", 0, "Stop after consuming for this long, e.g. \"5m\" (0 for no limit)")
+)
+
+// consumeLimits keeps track of how much has been consumed against the
+// -max-messages, -max-bytes, -idle-timeout and -duration flags
+type consumeLimits struct {
+	MaxMessages int
+	MaxBytes    int64
+	IdleTimeout time.Duration
+	Deadline    time.Time
+
+	messages int
+	bytes    int64
+}
+
+func newConsumeLimits() *consumeLimits {
+	limits := &consumeLimits{
+		MaxMessages: *maxMessages,
+		MaxBytes:    *maxBytes,
+		IdleTimeout: *idleTimeout,
+	}
+	if *runDuration > 0 {
+		limits.Deadline = time.Now().Add(*runDuration)
+	}
+	return limits
+}
+
+// Count records a message that has been handed over for output
+func (l *consumeLimits) Count(delivery amqp.Delivery) {
+	l.messages++
+	l.bytes += int64(len(delivery.Body))
+}
+
+// Reached returns why consuming should stop, or "" if it should carry on
+func (l *consumeLimits) Reached() string {
+	if shutdown.Requested() {
+		return "interrupted"
+	}
+	if l.MaxMessages > 0 && l.messages >= l.MaxMessages {
+		return fmt.Sprintf("read %d message(s)", l.messages)
+	}
+	if l.MaxBytes > 0 && l.bytes >= l.MaxBytes {
+		return fmt.Sprintf("read %d byte(s)", l.bytes)
+	}
+	if !l.Deadline.IsZero() && !time.Now().Before(l.Deadline) {
+		return "duration elapsed"
+	}
+	return ""
+}
+
+// Idle returns a channel that fires once the idle timeout has passed from
+// now, or nil if there is no idle timeout
+func (l *consumeLimits) Idle() <-chan time.Time {
+	if l.IdleTimeout <= 0 {
+		return nil
+	}
+	return time.After(l.IdleTimeout)
+}
+
+// Expired returns a channel that fires at the deadline, or nil if there is
+// no deadline
+func (l *consumeLimits) Expired() <-chan time.Time {
+	if l.Deadline.IsZero() {
+		return nil
+	}
+	return time.After(l.Deadline.Sub(time.Now()))
+}
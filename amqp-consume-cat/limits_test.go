@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConsumeLimitsReached(t *testing.T) {
+	limits := &consumeLimits{MaxMessages: 2, MaxBytes: 100}
+	if reason := limits.Reached(); reason != "" {
+		t.Errorf("expected no limit before any messages, got '%s'", reason)
+	}
+
+	limits.Count(amqp.Delivery{Body: make([]byte, 10)})
+	if reason := limits.Reached(); reason != "" {
+		t.Errorf("expected no limit after 1 message, got '%s'", reason)
+	}
+	limits.Count(amqp.Delivery{Body: make([]byte, 10)})
+	if reason := limits.Reached(); reason != "read 2 message(s)" {
+		t.Errorf("expected the message limit, got '%s'", reason)
+	}
+
+	limits = &consumeLimits{MaxBytes: 100}
+	limits.Count(amqp.Delivery{Body: make([]byte, 150)})
+	if reason := limits.Reached(); reason != "read 150 byte(s)" {
+		t.Errorf("expected the byte limit, got '%s'", reason)
+	}
+
+	limits = &consumeLimits{Deadline: time.Now().Add(-time.Second)}
+	if reason := limits.Reached(); reason != "duration elapsed" {
+		t.Errorf("expected the deadline, got '%s'", reason)
+	}
+}
+
+func TestConsumeLimitsTimers(t *testing.T) {
+	limits := &consumeLimits{}
+	if limits.Idle() != nil || limits.Expired() != nil {
+		t.Error("expected no timers without an idle timeout or deadline")
+	}
+
+	limits = &consumeLimits{IdleTimeout: 10 * time.Millisecond, Deadline: time.Now().Add(10 * time.Millisecond)}
+	for name, c := range map[string]<-chan time.Time{"idle": limits.Idle(), "deadline": limits.Expired()} {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Errorf("expected the %s timer to fire", name)
+		}
+	}
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"path"
+	"text/template"
 )
 
 import (
 	. "github.com/modcloth/amqp-tools"
-	"github.com/streadway/amqp"
 )
 
 const (
@@ -32,14 +34,23 @@ var (
 	showCatFlag = flag.Bool("mrow", false, "")
 	versionFlag = flag.Bool("version", false, "Print version and exit")
 	revFlag     = flag.Bool("rev", false, "Print git revision and exit")
+	readFlag    = flag.String("read", "", "Read messages back in from a -d directory, a -sink file: segment (which may be compressed), a directory of them or a -sink sqlite: database (.db, .sqlite or .sqlite3), and write them out as consumed messages would be, instead of consuming")
+	queryFlag   = flag.String("query", "", "With -read of a SQLite database written by the sqlite sink, write out the messages an SQL query against its messages table returns, e.g. \"SELECT * FROM messages WHERE routing_key LIKE 'order.%'\", instead of all of them")
+	verifyFlag  = flag.Bool("verify", false, "Scan the -d output directory for partial or corrupt message files, report them and exit")
+	bindingFile = flag.String("bindings", "", "JSON file of bindings, which may also declare their queues and exchanges and give binding arguments")
 	quit        = make(chan bool)
 
+	shutdown      *Shutdown
 	queueBindings QueueBindings
+	queueWeights  QueueWeights
+	taps          Taps
 	debugger      Debugger
 )
 
 func init() {
 	flag.Var(&queueBindings, "q", "Queue bindings specified as \"/\"-delimited strings of the form \"exchange/queue-name/routing-key\"")
+	flag.Var(&taps, "tap", "Stream copies of live traffic from an exchange, specified as \"exchange\" or \"exchange:pattern\", through a temporary queue. Implies -continuous")
+	flag.Var(&queueWeights, "weight", "Share of deliveries for a queue when consuming from several queues with -continuous, specified as \"queue-name=weight\" (default weight 1)")
 	flag.Var(&debugger, "debug", "Show debug output")
 }
 
@@ -47,7 +58,7 @@ func main() {
 	flag.Parse()
 
 	if *showCatFlag {
-		fmt.Println(CONSUME_CAT)
+		fmt.Print(CONSUME_CAT, "\n")
 		os.Exit(0)
 	}
 
@@ -68,6 +79,99 @@ func main() {
 		os.Exit(0)
 	}
 
+	shutdown = NotifyShutdown()
+
+	if err := checkDisposition(); err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+	acks = newAckBatcher()
+
+	if err := checkParking(); err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+
+	if err := CheckBodyFormat(*bodyFormat); err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+
+	messagePathTemplate, err := NewTemplate("path", *pathTemplate)
+	if err != nil {
+		fmt.Println("ERROR: invalid path template:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+
+	if *verifyFlag {
+		verifyOutput(messagePathTemplate)
+	}
+
+	if len(*pluginCommand) > 0 {
+		plugin, err = StartPlugin(*pluginCommand)
+		if err != nil {
+			fmt.Println("ERROR: unable to start plugin:", err)
+			os.Exit(NOT_COOL_ZEUS)
+		}
+	}
+
+	switch {
+	case len(*execCommand) > 0 && len(*sinkURI) > 0:
+		err = errors.New("-exec and -sink can not be used together")
+	case len(*webhookURL) > 0 && (len(*execCommand) > 0 || len(*sinkURI) > 0):
+		err = errors.New("-webhook can not be used with -exec or -sink")
+	case len(*webhookURL) > 0:
+		sink, err = newWebhookSink()
+	case len(*execCommand) > 0:
+		sink = &ExecSink{Command: *execCommand, RequeueCode: *execRequeueCode, Timeout: *execTimeout}
+	case len(*sinkURI) > 0:
+		sink, err = OpenSink(*sinkURI)
+	case len(*outDirFlag) > 0:
+		sink = &DirectorySink{
+			Path:         *outDirFlag,
+			Pretty:       *prettyPrint,
+			PathTemplate: messagePathTemplate,
+			ExtractBody:  *extractBody,
+		}
+	default:
+		sink, err = NewStdoutSink(*outputFormat, *prettyPrint, *columns)
+	}
+	if err != nil {
+		fmt.Println("ERROR: unable to open sink:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+	sink = concurrentSink(sink)
+
+	if len(*readFlag) > 0 {
+		readArchive()
+	} else if len(*queryFlag) > 0 {
+		fmt.Println("ERROR: -query requires a SQLite database, given with -read")
+		os.Exit(NOT_COOL_ZEUS)
+	}
+
+	if err := openParking(); err != nil {
+		fmt.Println("ERROR: unable to connect for parking messages:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+
+	if len(*bindingFile) > 0 {
+		bindings, err := LoadQueueBindings(*bindingFile)
+		if err != nil {
+			fmt.Println("ERROR: unable to load bindings:", err)
+			os.Exit(NOT_COOL_ZEUS)
+		}
+		queueBindings = append(queueBindings, bindings...)
+	}
+
+	if len(*firehosePattern) > 0 {
+		taps = append(taps, FirehoseExchange+":"+*firehosePattern)
+	}
+
+	if len(taps) > 0 {
+		queueBindings = append(queueBindings, taps.Bindings()...)
+		*continuousConsume = true
+	}
+
 	deliveries := make(chan interface{})
 
 	if len(queueBindings) > 0 {
@@ -78,15 +182,9 @@ func main() {
 		go ConsumeForBindings(*uriFlag, queueBindings, deliveries, debugger)
 
 		go func() {
-			for delivery := range deliveries {
-				switch delivery.(type) {
-				case nil:
-					debugger.Print("Done consuming. Thanks for playing!")
-					quit <- true
-				default:
-					HandleDelivery(delivery.(amqp.Delivery), debugger)
-				}
-			}
+			handleDeliveries(deliveries)
+			debugger.Print("Done consuming. Thanks for playing!")
+			quit <- true
 		}()
 	} else {
 		fmt.Println("ERROR: define at least one exchange/queue/binding argument.")
@@ -94,4 +192,100 @@ func main() {
 		os.Exit(NOT_COOL_ZEUS)
 	}
 	<-quit
+
+	if plugin != nil {
+		debugger.WithError(plugin.Close(), "Plugin exited with an error")
+	}
+	if parking != nil {
+		debugger.WithError(parking.Close(), "Unable to close the parking connection")
+	}
+	if err := sink.Close(); err != nil {
+		fmt.Println("ERROR: unable to close sink:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+	os.Exit(shutdown.ExitCode())
+}
+
+// verifyOutput reports every problem in the -d output directory, exiting
+// non-zero if there were any
+func verifyOutput(messagePathTemplate *template.Template) {
+	if len(*outDirFlag) == 0 {
+		fmt.Println("ERROR: -verify requires an output directory, given with -d")
+		os.Exit(NOT_COOL_ZEUS)
+	}
+
+	problems, err := VerifyDirectory(*outDirFlag, messagePathTemplate)
+	if err != nil {
+		fmt.Println("ERROR: unable to scan output directory:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in %s\n", len(problems), *outDirFlag)
+		os.Exit(1)
+	}
+	fmt.Println("No problems found in", *outDirFlag)
+	os.Exit(0)
+}
+
+// readArchive writes out every message in the -read archive, or those the
+// -query returns from a SQLite database, exiting once they have all been
+// written.  Messages go through the -plugin first, as consumed messages do,
+// and a message the plugin has an error verdict on is skipped.
+func readArchive() {
+	read := ReadArchive
+	if len(*queryFlag) > 0 || isSQLiteFile(*readFlag) {
+		read = func(path string, handle func(*DeliveryPlus) error) error {
+			return ReadSQLite(path, *queryFlag, handle)
+		}
+	}
+
+	err := read(*readFlag, func(delivery *DeliveryPlus) error {
+		if shutdown.Requested() {
+			return errInterrupted
+		}
+		return writeArchived(delivery)
+	})
+	if plugin != nil {
+		debugger.WithError(plugin.Close(), "Plugin exited with an error")
+	}
+	if closeErr := sink.Close(); err == nil || err == errInterrupted {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Println("ERROR: unable to read archive:", err)
+		os.Exit(NOT_COOL_ZEUS)
+	}
+	os.Exit(shutdown.ExitCode())
+}
+
+var errInterrupted = errors.New("interrupted")
+
+// writeArchived writes out a message read back in, through the -plugin if
+// there is one
+func writeArchived(delivery *DeliveryPlus) error {
+	outputs := []*DeliveryPlus{delivery}
+	if plugin != nil {
+		var err error
+		outputs, err = plugin.Process(delivery)
+		if _, ok := err.(*PluginError); ok {
+			log.Printf("Skipping message '%s': %s", delivery.RawDelivery.MessageId, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, output := range outputs {
+		err := RenderBody(output, *bodyFormat)
+		debugger.WithError(err, "Rendering body: ", err)
+		if err = sink.Write(output); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func TestMain(m *testing.M) {
+	// never closed, as no signal arrives during the tests
+	shutdown = &amqptools.Shutdown{C: make(chan struct{})}
+	os.Exit(m.Run())
+}
+
+func TestWriteArchived(t *testing.T) {
+	savedPlugin, savedSink := plugin, sink
+	defer func() { plugin, sink = savedPlugin, savedSink }()
+
+	var err error
+	plugin, err = amqptools.StartPlugin(`while read line; do case "$line" in ` +
+		`*'"MessageId":"drop"'*) echo '{"drop": true}';; ` +
+		`*'"MessageId":"bad"'*) echo '{"error": "bad tenant"}';; ` +
+		`*) echo "{\"messages\": [$line, $line]}";; esac; done`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close()
+	recording := &recordingSink{}
+	sink = recording
+
+	for _, id := range []string{"a", "drop", "bad", "b"} {
+		delivery := amqptools.NewDeliveryPlus("events", "orders", amqp.Publishing{MessageId: id})
+		if err = writeArchived(delivery); err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+	}
+
+	var ids []string
+	for _, delivery := range recording.deliveries {
+		ids = append(ids, delivery.RawDelivery.MessageId)
+	}
+	if strings.Join(ids, ",") != "a,a,b,b" {
+		t.Errorf("expected messages to go through the plugin, got %v", ids)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// QueueWeights maps queue names to their share of deliveries when consuming
+// from several queues at once.  Queues without a weight have a weight of 1.
+type QueueWeights map[string]int
+
+func (qw *QueueWeights) String() string {
+	return fmt.Sprint(map[string]int(*qw))
+}
+
+// Set is used by flag to assign contents to a custom type
+func (qw *QueueWeights) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return errors.New("queue weight argument requires a queue name and a weight, e.g. \"queue-name=3\"")
+	}
+	weight, err := strconv.Atoi(parts[1])
+	if err != nil || weight < 1 {
+		return fmt.Errorf("invalid weight '%s' for queue '%s'", parts[1], parts[0])
+	}
+	if *qw == nil {
+		*qw = make(QueueWeights)
+	}
+	(*qw)[parts[0]] = weight
+	return nil
+}
+
+// Weight returns the weight of a queue
+func (qw QueueWeights) Weight(queueName string) int {
+	if weight, ok := qw[queueName]; ok {
+		return weight
+	}
+	return 1
+}
+
+// multiplexDeliveries fans deliveries from every consumer channel into
+// deliveries until all of the consumer channels are closed or one of the
+// limits is reached, and returns why it stopped.
+//
+// Each queue may hand over up to its weight in messages per round.  A round
+// ends once every queue has used up its weight, or as soon as none of the
+// queues with weight left has a message waiting, so that a quiet queue never
+// holds up a busy one.
+func multiplexDeliveries(consumerChannels []consumerChannel, weights QueueWeights, limits *consumeLimits, deliveries chan interface{}) string {
+	open := make([]consumerChannel, len(consumerChannels))
+	copy(open, consumerChannels)
+
+	credits := make([]int, len(open))
+	resetCredits := func() {
+		for i, ch := range open {
+			credits[i] = weights.Weight(ch.binding.QueueName)
+		}
+	}
+	resetCredits()
+
+	for len(open) > 0 {
+		if reason := limits.Reached(); len(reason) > 0 {
+			return reason
+		}
+
+		var cases []reflect.SelectCase
+		var indexes []int
+		for i, ch := range open {
+			if credits[i] > 0 {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.deliveries)})
+				indexes = append(indexes, i)
+			}
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+
+		chosen, value, ok := reflect.Select(cases)
+		if chosen == len(cases)-1 {
+			// nothing waiting on the queues with weight left, so start a new
+			// round and wait on all of them
+			resetCredits()
+			cases = cases[:0]
+			indexes = indexes[:0]
+			for i, ch := range open {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.deliveries)})
+				indexes = append(indexes, i)
+			}
+			cases = append(cases,
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(limits.Idle())},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(limits.Expired())},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(shutdown.C)})
+
+			chosen, value, ok = reflect.Select(cases)
+			switch chosen {
+			case len(cases) - 3:
+				return fmt.Sprintf("idle for %s", limits.IdleTimeout)
+			case len(cases) - 2:
+				return "duration elapsed"
+			case len(cases) - 1:
+				return "interrupted"
+			}
+		}
+
+		index := indexes[chosen]
+		if !ok {
+			open = append(open[:index], open[index+1:]...)
+			credits = append(credits[:index], credits[index+1:]...)
+			continue
+		}
+
+		credits[index]--
+		delivery := value.Interface().(amqp.Delivery)
+		limits.Count(delivery)
+		deliveries <- delivery
+	}
+	return "all consumers closed"
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// queueChannel returns a consumer channel for a queue holding n messages,
+// closed once they have been read if closed is true
+func queueChannel(queueName string, n int, closed bool) consumerChannel {
+	deliveries := make(chan amqp.Delivery, n)
+	for i := 0; i < n; i++ {
+		deliveries <- amqp.Delivery{RoutingKey: queueName, Body: []byte("x")}
+	}
+	if closed {
+		close(deliveries)
+	}
+	return consumerChannel{deliveries: deliveries, binding: &QueueBinding{QueueName: queueName}}
+}
+
+// multiplexed runs multiplexDeliveries to completion, returning the routing
+// keys of the messages it passed on, in order, and why it stopped
+func multiplexed(consumerChannels []consumerChannel, weights QueueWeights, limits *consumeLimits) ([]string, string) {
+	deliveries := make(chan interface{}, 100)
+	reason := multiplexDeliveries(consumerChannels, weights, limits, deliveries)
+	close(deliveries)
+
+	var queues []string
+	for delivery := range deliveries {
+		queues = append(queues, delivery.(amqp.Delivery).RoutingKey)
+	}
+	return queues, reason
+}
+
+func TestQueueWeightsSet(t *testing.T) {
+	var weights QueueWeights
+	if err := weights.Set("orders=3"); err != nil {
+		t.Fatal(err)
+	}
+	if weights.Weight("orders") != 3 || weights.Weight("other") != 1 {
+		t.Errorf("unexpected weights %v", weights)
+	}
+	for _, value := range []string{"orders", "orders=0", "orders=many"} {
+		if err := weights.Set(value); err == nil {
+			t.Errorf("expected '%s' to be refused", value)
+		}
+	}
+}
+
+func TestMultiplexDeliveriesWeights(t *testing.T) {
+	weights := QueueWeights{"a": 3}
+	queues, reason := multiplexed([]consumerChannel{queueChannel("a", 8, true), queueChannel("b", 8, true)}, weights, &consumeLimits{})
+
+	if reason != "all consumers closed" || len(queues) != 16 {
+		t.Fatalf("expected all 16 messages until the consumers closed, got %d (%s)", len(queues), reason)
+	}
+
+	// while both queues have messages, each round takes 3 from a and 1 from b
+	counts := map[string]int{}
+	for _, queue := range queues[:8] {
+		counts[queue]++
+	}
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Errorf("expected 6 from a and 2 from b in the first two rounds, got %v in %v", counts, queues)
+	}
+}
+
+func TestMultiplexDeliveriesQuietQueue(t *testing.T) {
+	// b stays open but never has a message, which must not hold up a
+	limits := &consumeLimits{IdleTimeout: 20 * time.Millisecond}
+	queues, reason := multiplexed([]consumerChannel{queueChannel("a", 5, false), queueChannel("b", 0, false)}, nil, limits)
+
+	if len(queues) != 5 {
+		t.Errorf("expected all 5 messages from a, got %v", queues)
+	}
+	if reason != "idle for 20ms" {
+		t.Errorf("expected to stop when idle, got '%s'", reason)
+	}
+}
+
+func TestMultiplexDeliveriesLimits(t *testing.T) {
+	queues, reason := multiplexed([]consumerChannel{queueChannel("a", 10, true)}, nil, &consumeLimits{MaxMessages: 4})
+	if len(queues) != 4 || reason != "read 4 message(s)" {
+		t.Errorf("expected to stop after 4 messages, got %d (%s)", len(queues), reason)
+	}
+
+	limits := &consumeLimits{Deadline: time.Now().Add(20 * time.Millisecond)}
+	queues, reason = multiplexed([]consumerChannel{queueChannel("a", 0, false)}, nil, limits)
+	if len(queues) != 0 || reason != "duration elapsed" {
+		t.Errorf("expected to stop at the deadline, got %d (%s)", len(queues), reason)
+	}
+}
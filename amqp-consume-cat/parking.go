@@ -0,0 +1,197 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+var (
+	maxFailures    = flag.Int("max-failures", 0, "Park a message once handling it has failed this many times, rather than requeueing it forever (0 to always requeue). Failures are counted by MessageId, or by the x-delivery-count header of quorum queues")
+	parkExchange   = flag.String("park-exchange", "", "Exchange to publish parked messages to, with x-parked-* headers recording the error, before acking them")
+	parkRoutingKey = flag.String("park-routing-key", "", "Routing key to publish parked messages with (default the message's own routing key)")
+
+	failures = newFailureCounter()
+	parking  amqptools.Sink
+)
+
+// checkParking validates the parking flags
+func checkParking() error {
+	switch {
+	case *maxFailures < 0:
+		return errors.New("-max-failures can not be negative")
+	case *maxFailures > 0 && len(*parkExchange) == 0 && len(*parkRoutingKey) == 0:
+		return errors.New("-max-failures requires a -park-exchange or, to publish through the default exchange, a -park-routing-key naming the parking queue")
+	}
+	return nil
+}
+
+// openParking connects the publisher of parked messages, if there is to be
+// one, and makes sure that the parking exchange exists
+func openParking() error {
+	if *maxFailures == 0 {
+		return nil
+	}
+
+	s, err := amqptools.NewAMQPSink(*uriFlag)
+	if err != nil {
+		return err
+	}
+	if err = s.CheckExchange(*parkExchange); err != nil {
+		s.Close()
+		return err
+	}
+	s.Exchange = parkExchange
+	if len(*parkRoutingKey) > 0 {
+		s.RoutingKey = parkRoutingKey
+	}
+	parking = &lockedSink{Sink: s}
+	return nil
+}
+
+// maxTrackedFailures is how many failing messages are counted at once
+const maxTrackedFailures = 10000
+
+// failureCounter counts how many times handling each message has failed.
+// Messages that fail here and are then settled by other consumers are never
+// forgotten, so only the most recently failed maxTrackedFailures are kept.
+type failureCounter struct {
+	mutex sync.Mutex
+	// recent holds *failureCount, most recently failed first
+	recent *list.List
+	counts map[string]*list.Element
+}
+
+type failureCount struct {
+	key   string
+	count int
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{recent: list.New(), counts: make(map[string]*list.Element)}
+}
+
+// failureKey identifies a message across redeliveries, by its MessageId or,
+// if it has none, by a hash of where it was published and its body
+func failureKey(delivery amqp.Delivery) string {
+	if len(delivery.MessageId) > 0 {
+		return delivery.MessageId
+	}
+	hash := sha1.New()
+	hash.Write([]byte(delivery.Exchange + "\x00" + delivery.RoutingKey + "\x00"))
+	hash.Write(delivery.Body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Failed records a failure to handle a message, returning how many times it
+// has failed.  A quorum queue's x-delivery-count, the number of times the
+// message was delivered before, survives restarts, so it is trusted when it
+// counts more failures than have been seen here.
+func (c *failureCounter) Failed(delivery amqp.Delivery) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := failureKey(delivery)
+	element, ok := c.counts[key]
+	if ok {
+		c.recent.MoveToFront(element)
+	} else {
+		element = c.recent.PushFront(&failureCount{key: key})
+		c.counts[key] = element
+		if c.recent.Len() > maxTrackedFailures {
+			oldest := c.recent.Back()
+			c.recent.Remove(oldest)
+			delete(c.counts, oldest.Value.(*failureCount).key)
+		}
+	}
+
+	failure := element.Value.(*failureCount)
+	failure.count++
+	if previous, ok := headerInt(delivery.Headers["x-delivery-count"]); ok && previous+1 > failure.count {
+		failure.count = previous + 1
+	}
+	return failure.count
+}
+
+// Forget stops counting failures for a message that has been settled
+func (c *failureCounter) Forget(delivery amqp.Delivery) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := failureKey(delivery)
+	if element, ok := c.counts[key]; ok {
+		c.recent.Remove(element)
+		delete(c.counts, key)
+	}
+}
+
+func headerInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// parkDelivery publishes a copy of a message that keeps failing to the
+// parking exchange, with headers recording why.  The copy has no expiration,
+// so that it waits for someone to look at it.
+func parkDelivery(delivery amqp.Delivery, count int, reason error) error {
+	headers := amqp.Table{}
+	for name, value := range delivery.Headers {
+		headers[name] = value
+	}
+	headers["x-parked-error"] = reason.Error()
+	headers["x-parked-failures"] = int64(count)
+	headers["x-parked-at"] = time.Now().UTC().Truncate(time.Second)
+	headers["x-parked-exchange"] = delivery.Exchange
+	headers["x-parked-routing-key"] = delivery.RoutingKey
+	headers["x-parked-by"] = consumerTag
+
+	parked := &amqptools.DeliveryPlus{RawDelivery: delivery, Data: make(map[string]interface{})}
+	parked.RawDelivery.Headers = headers
+	parked.RawDelivery.Expiration = ""
+
+	return parking.Write(parked)
+}
+
+// parkIfPoisoned counts a failure to handle a message and parks it once it
+// has failed -max-failures times, acking the original and reporting whether
+// it did.  The original is only acked once the broker has confirmed that the
+// parked copy was routed to a queue; a message that can not be parked is left
+// to be requeued.
+func parkIfPoisoned(delivery amqp.Delivery, reason error) (bool, error) {
+	if *maxFailures == 0 || browsing() {
+		return false, nil
+	}
+
+	count := failures.Failed(delivery)
+	if count < *maxFailures {
+		return false, nil
+	}
+
+	log.Printf("Parking message '%s' after %d failure(s): %s", delivery.MessageId, count, reason)
+	if err := parkDelivery(delivery, count, reason); err != nil {
+		log.Printf("Unable to park message '%s', requeueing it: %s", delivery.MessageId, err)
+		return false, nil
+	}
+
+	failures.Forget(delivery)
+	acks.Handled(delivery)
+	return true, delivery.Ack(false)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+import (
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+// recordingSink keeps what it is given, failing instead if err is set
+type recordingSink struct {
+	deliveries []*amqptools.DeliveryPlus
+	err        error
+}
+
+func (s *recordingSink) Write(delivery *amqptools.DeliveryPlus) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.deliveries = append(s.deliveries, delivery)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+// withParking sets the parking flags for the length of a test
+func withParking(t *testing.T, max int, exchange, routingKey string) {
+	savedMax, savedExchange, savedRoutingKey := *maxFailures, *parkExchange, *parkRoutingKey
+	savedParking, savedFailures, savedAcks := parking, failures, acks
+	t.Cleanup(func() {
+		*maxFailures, *parkExchange, *parkRoutingKey = savedMax, savedExchange, savedRoutingKey
+		parking, failures, acks = savedParking, savedFailures, savedAcks
+	})
+
+	*maxFailures, *parkExchange, *parkRoutingKey = max, exchange, routingKey
+	failures = newFailureCounter()
+}
+
+func TestCheckParking(t *testing.T) {
+	for _, test := range []struct {
+		max        int
+		exchange   string
+		routingKey string
+		valid      bool
+	}{
+		{0, "", "", true},
+		{3, "parked", "", true},
+		{3, "", "parked-orders", true},
+		{3, "", "", false},
+		{-1, "parked", "", false},
+	} {
+		withParking(t, test.max, test.exchange, test.routingKey)
+		if err := checkParking(); (err == nil) != test.valid {
+			t.Errorf("%+v: unexpected result %v", test, err)
+		}
+	}
+}
+
+func TestFailureKey(t *testing.T) {
+	withId := amqp.Delivery{MessageId: "abc", Exchange: "events", Body: []byte("1")}
+	if failureKey(withId) != "abc" {
+		t.Errorf("expected a message id to be the key, got %s", failureKey(withId))
+	}
+
+	// without a message id, the same message redelivered has the same key,
+	// and a different message or the same body published elsewhere does not
+	message := amqp.Delivery{Exchange: "events", RoutingKey: "order.created", Body: []byte(`{"id": 1}`)}
+	redelivered := message
+	redelivered.Redelivered = true
+	redelivered.DeliveryTag = 7
+	other := message
+	other.Body = []byte(`{"id": 2}`)
+	elsewhere := message
+	elsewhere.RoutingKey = "order.shipped"
+
+	if failureKey(message) != failureKey(redelivered) {
+		t.Error("expected a redelivered message to keep its key")
+	}
+	if failureKey(message) == failureKey(other) || failureKey(message) == failureKey(elsewhere) {
+		t.Error("expected different messages to have different keys")
+	}
+}
+
+func TestFailureCounter(t *testing.T) {
+	c := newFailureCounter()
+	a := amqp.Delivery{MessageId: "a"}
+	b := amqp.Delivery{MessageId: "b"}
+
+	for i, expected := range []int{1, 2, 3} {
+		if count := c.Failed(a); count != expected {
+			t.Errorf("failure %d: expected %d, got %d", i+1, expected, count)
+		}
+	}
+	if count := c.Failed(b); count != 1 {
+		t.Errorf("expected messages to be counted apart, got %d", count)
+	}
+
+	c.Forget(a)
+	if count := c.Failed(a); count != 1 {
+		t.Errorf("expected a settled message to be forgotten, got %d", count)
+	}
+
+	// a quorum queue's count survives restarts, so it wins when it is higher,
+	// but not when fewer failures were counted there than here
+	quorum := amqp.Delivery{MessageId: "q", Headers: amqp.Table{"x-delivery-count": int64(4)}}
+	if count := c.Failed(quorum); count != 5 {
+		t.Errorf("expected x-delivery-count to be trusted, got %d", count)
+	}
+	quorum.Headers["x-delivery-count"] = int32(1)
+	if count := c.Failed(quorum); count != 6 {
+		t.Errorf("expected the local count to win, got %d", count)
+	}
+}
+
+func TestFailureCounterEviction(t *testing.T) {
+	c := newFailureCounter()
+	first := amqp.Delivery{MessageId: "first"}
+	second := amqp.Delivery{MessageId: "second"}
+	c.Failed(first)
+	c.Failed(second)
+
+	// failing again makes first the most recent, so second is the oldest
+	c.Failed(first)
+	for i := 0; i < maxTrackedFailures-1; i++ {
+		c.Failed(amqp.Delivery{MessageId: fmt.Sprint(i)})
+	}
+
+	if len(c.counts) != maxTrackedFailures || c.recent.Len() != maxTrackedFailures {
+		t.Errorf("expected %d messages to be tracked, got %d and %d", maxTrackedFailures, len(c.counts), c.recent.Len())
+	}
+	if count := c.Failed(first); count != 3 {
+		t.Errorf("expected a recently failed message to be kept, got %d", count)
+	}
+	if count := c.Failed(second); count != 1 {
+		t.Errorf("expected the oldest message to be forgotten, got %d", count)
+	}
+}
+
+func TestParkIfPoisoned(t *testing.T) {
+	withDisposition(t, "ack", 0, 0)
+	withParking(t, 2, "parked", "")
+	sink := &recordingSink{}
+	parking = sink
+	acks = newAckBatcher()
+
+	acknowledger := &recordingAcknowledger{}
+	delivery := acknowledger.delivery(1)
+	delivery.MessageId = "abc"
+	delivery.Exchange = "events"
+	delivery.RoutingKey = "order.created"
+	delivery.Expiration = "60000"
+	delivery.Headers = amqp.Table{"tenant": "acme"}
+	reason := errors.New("bad tenant")
+
+	if parked, err := parkIfPoisoned(delivery, reason); parked || err != nil {
+		t.Fatalf("expected the first failure to be requeued, got %t, %v", parked, err)
+	}
+
+	// the parking exchange is down, so the message carries on being requeued
+	sink.err = errors.New("connection refused")
+	if parked, err := parkIfPoisoned(delivery, reason); parked || err != nil {
+		t.Fatalf("expected a message that can not be parked to be requeued, got %t, %v", parked, err)
+	}
+	if len(acknowledger.frames) != 0 {
+		t.Fatalf("expected nothing to be settled, got %q", acknowledger.frames)
+	}
+
+	sink.err = nil
+	if parked, err := parkIfPoisoned(delivery, reason); !parked || err != nil {
+		t.Fatalf("expected the message to be parked, got %t, %v", parked, err)
+	}
+	if expected := []string{"ack 1 multiple=false"}; !reflect.DeepEqual(acknowledger.frames, expected) {
+		t.Errorf("expected %q, got %q", expected, acknowledger.frames)
+	}
+	if len(sink.deliveries) != 1 {
+		t.Fatalf("expected 1 parked message, got %d", len(sink.deliveries))
+	}
+
+	parked := sink.deliveries[0].RawDelivery
+	if parked.Expiration != "" || parked.Headers["tenant"] != "acme" || parked.Headers["x-parked-error"] != "bad tenant" ||
+		parked.Headers["x-parked-failures"] != int64(3) || parked.Headers["x-parked-routing-key"] != "order.created" {
+		t.Errorf("unexpected parked message %+v", parked)
+	}
+	if _, ok := delivery.Headers["x-parked-error"]; ok {
+		t.Error("expected the original headers to be left alone")
+	}
+	if _, ok := failures.counts["abc"]; ok {
+		t.Error("expected a parked message to be forgotten")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id               INTEGER PRIMARY KEY AUTOINCREMENT,
+	consumed_at      TEXT NOT NULL,
+	exchange         TEXT NOT NULL,
+	routing_key      TEXT NOT NULL,
+	message_id       TEXT NOT NULL,
+	correlation_id   TEXT NOT NULL,
+	content_type     TEXT NOT NULL,
+	content_encoding TEXT NOT NULL,
+	type             TEXT NOT NULL,
+	app_id           TEXT NOT NULL,
+	user_id          TEXT NOT NULL,
+	reply_to         TEXT NOT NULL,
+	expiration       TEXT NOT NULL,
+	priority         INTEGER NOT NULL,
+	delivery_mode    INTEGER NOT NULL,
+	timestamp        TEXT NOT NULL,
+	redelivered      INTEGER NOT NULL,
+	headers          TEXT NOT NULL,
+	body             BLOB NOT NULL,
+	data             TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_exchange ON messages (exchange, routing_key);
+CREATE INDEX IF NOT EXISTS messages_routing_key ON messages (routing_key);
+CREATE INDEX IF NOT EXISTS messages_message_id ON messages (message_id);
+CREATE INDEX IF NOT EXISTS messages_correlation_id ON messages (correlation_id);
+CREATE INDEX IF NOT EXISTS messages_type ON messages (type);
+CREATE INDEX IF NOT EXISTS messages_app_id ON messages (app_id);
+CREATE INDEX IF NOT EXISTS messages_timestamp ON messages (timestamp);
+CREATE INDEX IF NOT EXISTS messages_consumed_at ON messages (consumed_at);
+`
+
+// defaultSQLiteQuery reads back every message in the order it was written
+const defaultSQLiteQuery = "SELECT * FROM messages ORDER BY id"
+
+// SQLiteSink inserts each message into the messages table of a SQLite
+// database, which is created if need be.  Times are stored as RFC3339 in UTC,
+// or empty if the message has no timestamp, so that they sort and compare as
+// text, and headers and data as JSON.
+type SQLiteSink struct {
+	db     *sql.DB
+	insert *sql.Stmt
+}
+
+// NewSQLiteSink opens a SQLite database and makes sure it has a messages table
+func NewSQLiteSink(path string) (*SQLiteSink, error) {
+	dsn, err := sqliteDSN(path, "rwc")
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	insert, err := db.Prepare(`INSERT INTO messages (
+		consumed_at, exchange, routing_key, message_id, correlation_id,
+		content_type, content_encoding, type, app_id, user_id, reply_to,
+		expiration, priority, delivery_mode, timestamp, redelivered,
+		headers, body, data
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteSink{db: db, insert: insert}, nil
+}
+
+func (s *SQLiteSink) Write(deliveryPlus *amqptools.DeliveryPlus) error {
+	d := deliveryPlus.RawDelivery
+
+	headers, err := json.Marshal(d.Headers)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(deliveryPlus.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.insert.Exec(
+		time.Now().UTC().Format(time.RFC3339Nano), d.Exchange, d.RoutingKey,
+		d.MessageId, d.CorrelationId, d.ContentType, d.ContentEncoding, d.Type,
+		d.AppId, d.UserId, d.ReplyTo, d.Expiration, d.Priority, d.DeliveryMode,
+		formatSQLiteTime(d.Timestamp), d.Redelivered,
+		string(headers), d.Body, string(data))
+	return err
+}
+
+func (s *SQLiteSink) Close() error {
+	s.insert.Close()
+	return s.db.Close()
+}
+
+// sqliteDSN builds a file: URI for a database, escaping characters such as ?
+// and # that would otherwise be taken for part of the URI.  The path is made
+// absolute, since a relative one would be taken for the URI's host.
+func sqliteDSN(path, mode string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dsn := &url.URL{Scheme: "file", Path: absPath, RawQuery: "mode=" + mode}
+	return dsn.String(), nil
+}
+
+func formatSQLiteTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// isSQLiteFile reports whether a path looks like a SQLite database written by
+// the sqlite sink
+func isSQLiteFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".db", ".sqlite", ".sqlite3":
+		return true
+	}
+	return false
+}
+
+// ReadSQLite runs a query against a SQLite database written by the sqlite
+// sink, opened read-only, and calls handle with a message built from each row
+// in turn, stopping at the first error.  Columns of the messages table fill in
+// the message they name; any others, such as computed ones, are added to its
+// Data.  An empty query reads every message.
+func ReadSQLite(path, query string, handle func(*amqptools.DeliveryPlus) error) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	dsn, err := sqliteDSN(path, "ro")
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(query) == 0 {
+		query = defaultSQLiteQuery
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return err
+		}
+		delivery, err := sqliteDelivery(columns, values)
+		if err != nil {
+			return err
+		}
+		if err = handle(delivery); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sqliteDelivery builds a message from a row of the messages table
+func sqliteDelivery(columns []string, values []interface{}) (*amqptools.DeliveryPlus, error) {
+	delivery := &amqptools.DeliveryPlus{Data: make(map[string]interface{})}
+	d := &delivery.RawDelivery
+	extra := make(map[string]interface{})
+
+	for i, column := range columns {
+		value := values[i]
+		text := sqliteText(value)
+
+		var err error
+		switch column {
+		case "id", "consumed_at":
+		case "exchange":
+			d.Exchange = text
+		case "routing_key":
+			d.RoutingKey = text
+		case "message_id":
+			d.MessageId = text
+		case "correlation_id":
+			d.CorrelationId = text
+		case "content_type":
+			d.ContentType = text
+		case "content_encoding":
+			d.ContentEncoding = text
+		case "type":
+			d.Type = text
+		case "app_id":
+			d.AppId = text
+		case "user_id":
+			d.UserId = text
+		case "reply_to":
+			d.ReplyTo = text
+		case "expiration":
+			d.Expiration = text
+		case "priority":
+			d.Priority = uint8(sqliteInt(value))
+		case "delivery_mode":
+			d.DeliveryMode = uint8(sqliteInt(value))
+		case "redelivered":
+			d.Redelivered = sqliteInt(value) != 0
+		case "timestamp":
+			if len(text) > 0 {
+				d.Timestamp, err = time.Parse(time.RFC3339Nano, text)
+			}
+		case "headers":
+			if len(text) > 0 {
+				d.Headers, err = headersFromJSON(text)
+			}
+		case "body":
+			d.Body = []byte(text)
+		case "data":
+			if len(text) > 0 {
+				err = json.Unmarshal([]byte(text), &delivery.Data)
+			}
+		default:
+			extra[column] = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %s", column, err)
+		}
+	}
+
+	if delivery.Data == nil {
+		delivery.Data = make(map[string]interface{})
+	}
+	for column, value := range extra {
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		delivery.Data[column] = value
+	}
+	return delivery, nil
+}
+
+// headersFromJSON decodes headers stored as JSON, keeping whole numbers as
+// integers rather than doubles
+func headersFromJSON(text string) (amqp.Table, error) {
+	var headers map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	if err := decoder.Decode(&headers); err != nil {
+		return nil, err
+	}
+	return amqptools.TableFromJSON(headers), nil
+}
+
+func sqliteText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+func sqliteInt(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+func init() {
+	// sqlite:<path>
+	amqptools.RegisterSink("sqlite", func(u *url.URL) (amqptools.Sink, error) {
+		path := u.Opaque
+		if len(path) == 0 {
+			path = u.Host + u.Path
+		}
+		if len(path) == 0 {
+			return nil, errors.New("sqlite sink requires a database path, e.g. \"sqlite:messages.db\"")
+		}
+		return NewSQLiteSink(path)
+	})
+}
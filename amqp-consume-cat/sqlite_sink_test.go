@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consume-cat-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// characters that mean something in a file: URI
+	path := filepath.Join(dir, "what?#%.db")
+	if !isSQLiteFile(path) {
+		t.Errorf("expected %s to be read as a SQLite database", path)
+	}
+
+	sink, err := NewSQLiteSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2013, 9, 24, 12, 0, 0, 0, time.UTC)
+	for _, routingKey := range []string{"order.created", "order.shipped", "user.deleted"} {
+		delivery := amqptools.NewDeliveryPlus("events", routingKey, amqp.Publishing{
+			MessageId: routingKey,
+			Timestamp: timestamp,
+			Priority:  3,
+			Headers:   amqp.Table{"attempt": int32(2), "tenant": "acme"},
+			Body:      []byte(`{"id": 1}`),
+		})
+		if err = sink.Write(delivery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var all []*amqptools.DeliveryPlus
+	err = ReadSQLite(path, "", func(delivery *amqptools.DeliveryPlus) error {
+		all = append(all, delivery)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(all))
+	}
+
+	d := all[0].RawDelivery
+	if d.Exchange != "events" || d.RoutingKey != "order.created" || d.MessageId != "order.created" ||
+		d.Priority != 3 || !d.Timestamp.Equal(timestamp) || string(d.Body) != `{"id": 1}` {
+		t.Errorf("message did not survive the round trip: %+v", d)
+	}
+	if attempt, ok := d.Headers["attempt"].(int64); !ok || attempt != 2 {
+		t.Errorf("expected an integer header, got %#v", d.Headers["attempt"])
+	}
+	if d.Headers["tenant"] != "acme" {
+		t.Errorf("unexpected headers %v", d.Headers)
+	}
+
+	var orders []*amqptools.DeliveryPlus
+	query := "SELECT *, length(body) AS size FROM messages WHERE routing_key LIKE 'order.%' ORDER BY id"
+	err = ReadSQLite(path, query, func(delivery *amqptools.DeliveryPlus) error {
+		orders = append(orders, delivery)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 || orders[1].RawDelivery.RoutingKey != "order.shipped" {
+		t.Fatalf("unexpected query results %v", orders)
+	}
+	if size, ok := orders[0].Data["size"].(int64); !ok || size != 9 {
+		t.Errorf("expected the computed column in Data, got %#v", orders[0].Data)
+	}
+
+	opened, err := amqptools.OpenSink("sqlite:" + filepath.Join(dir, "messages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened.Close()
+
+	err = ReadSQLite(path, "DELETE FROM messages", func(*amqptools.DeliveryPlus) error { return nil })
+	if err == nil {
+		t.Error("expected the database to be opened read-only")
+	}
+}
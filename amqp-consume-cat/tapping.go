@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Taps is a list of exchanges, each with an optional binding pattern, to sniff
+// through a temporary queue
+type Taps []string
+
+func (t *Taps) String() string {
+	return fmt.Sprint(*t)
+}
+
+// Set is used by flag to assign contents to a custom type
+func (t *Taps) Set(value string) error {
+	if len(strings.SplitN(value, ":", 2)[0]) == 0 {
+		return errors.New("tap argument requires an exchange name, e.g. \"exchange\" or \"exchange:pattern\"")
+	}
+	*t = append(*t, value)
+	return nil
+}
+
+// Bindings returns bindings of a single server-named, exclusive, auto-delete
+// queue to each tapped exchange.  The queue goes away when the connection
+// does, so production queues are never touched.  Taps without a pattern
+// receive everything published to a topic exchange.
+func (t Taps) Bindings() QueueBindings {
+	var bindings QueueBindings
+	var tapQueue *QueueBinding
+
+	for _, tap := range t {
+		parts := strings.SplitN(tap, ":", 2)
+		pattern := "#"
+		if len(parts) == 2 {
+			pattern = parts[1]
+		}
+
+		binding := &QueueBinding{
+			Exchange:   parts[0],
+			RoutingKey: pattern,
+			parts:      []string{parts[0], "", pattern},
+		}
+		if tapQueue == nil {
+			binding.DeclareQueue = &QueueDeclaration{AutoDelete: true, Exclusive: true}
+			tapQueue = binding
+		} else {
+			binding.queueFrom = tapQueue
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings
+}
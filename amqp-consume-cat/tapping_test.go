@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTapsSet(t *testing.T) {
+	var taps Taps
+	for _, value := range []string{"events", "orders:order.*"} {
+		if err := taps.Set(value); err != nil {
+			t.Errorf("unexpected error for '%s': %s", value, err)
+		}
+	}
+	for _, value := range []string{"", ":order.*"} {
+		if err := taps.Set(value); err == nil {
+			t.Errorf("expected '%s' to be refused", value)
+		}
+	}
+	if len(taps) != 2 {
+		t.Errorf("unexpected taps %v", taps)
+	}
+}
+
+func TestTapsBindings(t *testing.T) {
+	bindings := Taps{"events", "orders:order.*"}.Bindings()
+	if len(bindings) != 2 {
+		t.Fatalf("expected a binding per tap, got %v", bindings)
+	}
+
+	first, second := bindings[0], bindings[1]
+	if first.Exchange != "events" || first.RoutingKey != "#" {
+		t.Errorf("expected a tap without a pattern to get everything, got %s", first)
+	}
+	if second.Exchange != "orders" || second.RoutingKey != "order.*" || second.String() != "orders/_/order.*" {
+		t.Errorf("unexpected binding %s", second)
+	}
+
+	// one temporary queue is declared, by the first tap, and shared by the
+	// rest, so that production queues are never touched
+	if first.QueueName != "" || first.DeclareQueue == nil || !first.DeclareQueue.Exclusive || !first.DeclareQueue.AutoDelete {
+		t.Errorf("expected the first tap to declare a server-named exclusive, auto-delete queue, got %+v", first.DeclareQueue)
+	}
+	if second.DeclareQueue != nil || second.queueFrom != first {
+		t.Errorf("expected the second tap to share the first tap's queue")
+	}
+}
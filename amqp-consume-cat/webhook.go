@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/modcloth/amqp-tools"
+)
+
+var (
+	webhookURL     = flag.String("webhook", "", "POST each message to this URL. A 2xx response acks, a 4xx rejects and a 5xx or failed request is retried with backoff and then requeued. A user and password in the URL are sent as basic auth")
+	webhookBody    = flag.String("webhook-body", "json", "What a -webhook POSTs: json for the message as JSON, or raw for its body with its properties in X-AMQP-* headers")
+	webhookTimeout = flag.Duration("webhook-timeout", 30*time.Second, "Give up on a -webhook request that takes longer than this")
+	webhookRetries = flag.Int("webhook-retries", 3, "Number of times to retry a -webhook request that fails or gets a 5xx, 408 or 429 response before requeueing its message")
+	webhookBackoff = flag.Duration("webhook-backoff", time.Second, "Wait this long before retrying a -webhook request, twice as long before the next retry and so on")
+
+	webhookHeaders WebhookHeaders
+)
+
+func init() {
+	flag.Var(&webhookHeaders, "webhook-header", "Header to send with each -webhook request, specified as \"Name: value\", e.g. \"Authorization: Bearer ...\"")
+}
+
+// WebhookHeaders are the headers sent with each -webhook request
+type WebhookHeaders []string
+
+func (wh *WebhookHeaders) String() string {
+	return fmt.Sprint(*wh)
+}
+
+// Set is used by flag to assign contents to a custom type
+func (wh *WebhookHeaders) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return errors.New("webhook-header argument must be of the form \"Name: value\"")
+	}
+	*wh = append(*wh, value)
+	return nil
+}
+
+// Header returns the headers as an http.Header
+func (wh WebhookHeaders) Header() http.Header {
+	header := make(http.Header)
+	for _, value := range wh {
+		parts := strings.SplitN(value, ":", 2)
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return header
+}
+
+// newWebhookSink builds the -webhook sink from its flags
+func newWebhookSink() (amqptools.Sink, error) {
+	sink, err := amqptools.NewHTTPSink(*webhookURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch *webhookBody {
+	case "json":
+	case "raw":
+		sink.Raw = true
+	default:
+		return nil, errors.New("unknown webhook body '" + *webhookBody + "', expected json or raw")
+	}
+
+	sink.Client.Timeout = *webhookTimeout
+	sink.Retries = *webhookRetries
+	sink.Backoff = *webhookBackoff
+	for name, values := range webhookHeaders.Header() {
+		sink.Headers[name] = values
+	}
+	return sink, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"sync"
+)
+
+import (
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+var (
+	execCommand     = flag.String("exec", "", "Run this shell command for each message, like xargs for AMQP: the body goes to its stdin and the properties to AMQP_* environment variables (AMQP_MESSAGE_ID, AMQP_HEADER_X_TENANT, ...). Exit 0 acks, -exec-requeue-code requeues and any other failure rejects")
+	execRequeueCode = flag.Int("exec-requeue-code", amqptools.DefaultRequeueCode, "Exit status with which an -exec command asks for its message to be requeued")
+	execTimeout     = flag.Duration("exec-timeout", 0, "Kill an -exec command that runs for longer than this, e.g. 30s, and reject its message (0 for no timeout)")
+	concurrency     = flag.Int("concurrency", 1, "Number of messages to handle at once. Sinks that can not be written to concurrently, which is all but exec, http and -webhook, are still written one message at a time. Raise -prefetch-count to match")
+)
+
+// lockedSink makes a sink safe to write to from several handlers
+type lockedSink struct {
+	amqptools.Sink
+	mutex sync.Mutex
+}
+
+func (s *lockedSink) Write(delivery *amqptools.DeliveryPlus) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Sink.Write(delivery)
+}
+
+// concurrentSink wraps a sink in a lock when messages are handled
+// concurrently and it can not take concurrent writes
+func concurrentSink(s amqptools.Sink) amqptools.Sink {
+	if *concurrency <= 1 {
+		return s
+	}
+	if cs, ok := s.(amqptools.ConcurrentSink); ok && cs.ConcurrentWrites() {
+		return s
+	}
+	return &lockedSink{Sink: s}
+}
+
+// handleDeliveries hands each delivery to HandleDelivery, running up to
+// -concurrency of them at once, until the deliveries channel is closed
+func handleDeliveries(deliveries chan interface{}) {
+	var inFlight sync.WaitGroup
+	slots := make(chan bool, *concurrency)
+
+	for delivery := range deliveries {
+		switch d := delivery.(type) {
+		case chan bool:
+			// the consumer is waiting for everything so far to be handled
+			inFlight.Wait()
+			close(d)
+		case amqp.Delivery:
+			slots <- true
+			inFlight.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					inFlight.Done()
+				}()
+				HandleDelivery(d, debugger)
+			}()
+		}
+	}
+	inFlight.Wait()
+}
+
+// waitForHandlers returns once every delivery sent so far has been handled
+func waitForHandlers(deliveries chan interface{}) {
+	handled := make(chan bool)
+	deliveries <- handled
+	<-handled
+}
+
+// rejectDelivery rejects a message without requeueing it, dead-lettering it
+// if its queue has a DLX, unless it is being held until the end of a browse
+func rejectDelivery(delivery amqp.Delivery) error {
+	failures.Forget(delivery)
+	acks.Handled(delivery)
+	if browsing() {
+		return nil
+	}
+	return delivery.Reject(false)
+}
@@ -10,6 +10,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	. "github.com/modcloth/amqp-tools"
@@ -36,6 +37,8 @@ var (
 	mandatoryFlag   = flag.Bool("mandatory", false, "Publish message with mandatory property set.")
 	immediateFlag   = flag.Bool("immediate", false, "Publish message with immediate property set.")
 	numRoutinesFlag = flag.Int("threads", 3, "Number of concurrent publishers")
+	pluginFlag      = flag.String("plugin", "", "Long-running command to pipe each message through before it is published")
+	transformFlag   = flag.String("transform", "", "File of JSON Patch, merge patch and template transforms to apply to each message before it is published")
 	revFlag         = false
 	versionFlag     = false
 
@@ -46,6 +49,22 @@ filename entry and it is "-", then file names will be read from standard
 input assuming entries delimited by at least a line feed ("\n").  Any extra
 whitespace in each entry will be stripped before attempting to open the file.
 
+With -transform, each message is rewritten just before it is published by the
+transforms in the given file, a JSON array of {"json-patch": [...]},
+{"merge-patch": {...}} and {"template": {"body": "...", "properties": {...}}}
+entries applied in order.  The file being published is available to templates
+as {{.Data.File}}.
+
+With -plugin, each message is piped through a long-running command after any
+transforms.  The command reads one JSON DeliveryPlus per line on stdin and
+answers each with one line on stdout: {"messages": [...]} to publish zero or
+more messages in its place, {"drop": true} or {"error": "reason"}.
+
+On SIGINT or SIGTERM no more files are published, and once the messages
+already published have been confirmed a summary is printed and the exit code
+is 128 plus the signal number, e.g. 130 for SIGINT.  A second signal exits
+immediately with code 99.
+
 `
 )
 
@@ -110,11 +129,34 @@ func main() {
 			*amqpPasswordFlag, *amqpHostFlag, *amqpPortFlag, *amqpVHostFlag)
 	}
 
+	var transforms Transformer
+	if len(*transformFlag) > 0 {
+		loaded, err := LoadTransforms(*transformFlag)
+		if err != nil {
+			log.Println("FATAL: Unable to load transforms", err)
+			os.Exit(argParsingError)
+		}
+		transforms = loaded
+	}
+
+	var plugin *Plugin
+	if len(*pluginFlag) > 0 {
+		started, err := StartPlugin(*pluginFlag)
+		if err != nil {
+			log.Println("FATAL: Unable to start plugin", err)
+			os.Exit(argParsingError)
+		}
+		plugin = started
+	}
+
+	shutdown := NotifyShutdown()
+
 	fileChan := make(chan string)
 	resultChan := make(chan *PublishResult)
+	fileNames := make(chan string)
 
 	go func() {
-		defer close(fileChan)
+		defer close(fileNames)
 
 		if len(files) == 1 && files[0] == "-" {
 			log.Println("Reading files from stdin")
@@ -127,21 +169,55 @@ func main() {
 					}
 					break
 				}
-				fileChan <- strings.TrimSpace(line)
+				fileNames <- strings.TrimSpace(line)
 			}
 		} else {
 			log.Println("Using files provided on command line")
 			for _, file := range files {
-				fileChan <- file
+				fileNames <- file
 			}
 		}
 	}()
 
+	// stop handing out files on a signal, even while waiting on stdin, so
+	// that the publishers can finish what they have and wait for its confirms
+	go func() {
+		defer close(fileChan)
+
+		for {
+			select {
+			case file, ok := <-fileNames:
+				if !ok {
+					return
+				}
+				select {
+				case fileChan <- file:
+				case <-shutdown.C:
+					return
+				}
+			case <-shutdown.C:
+				return
+			}
+		}
+	}()
+
+	var publishers sync.WaitGroup
 	for i := 0; i < *numRoutinesFlag; i++ {
-		go PublishFiles(fileChan, connectionUri, exchange, *routingKeyFlag,
-			*mandatoryFlag, *immediateFlag, deliveryProperties.DeliveryPropertiesGenerator(), resultChan)
+		publishers.Add(1)
+		go func() {
+			defer publishers.Done()
+			PublishFiles(fileChan, connectionUri, exchange, *routingKeyFlag,
+				*mandatoryFlag, *immediateFlag, deliveryProperties.DeliveryPropertiesGenerator(),
+				transforms, plugin, resultChan)
+		}()
 	}
 
+	go func() {
+		publishers.Wait()
+		close(resultChan)
+	}()
+
+	errorCount := 0
 	for result := range resultChan {
 		if result.Error != nil {
 			if result.IsFatal {
@@ -150,12 +226,25 @@ func main() {
 			} else {
 				log.Println("ERROR:", result.Message, result.Error)
 				hadError = true
+				errorCount++
 			}
 		} else {
 			log.Println(result.Message)
 		}
 	}
 
+	if plugin != nil {
+		if err := plugin.Close(); err != nil {
+			log.Println("ERROR: Plugin exited with an error", err)
+		}
+	}
+
+	log.Printf("Published %d confirmed message(s), %d error(s)", confirmed, errorCount)
+
+	if shutdown.Requested() {
+		os.Exit(shutdown.ExitCode())
+	}
+
 	if hadError {
 		os.Exit(partialFailure)
 	} else {
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"mime"
 	"path/filepath"
+	"sync/atomic"
 )
 
 import (
@@ -14,16 +15,27 @@ import (
 )
 
 func PublishFiles(files chan string, connectionUri, exchange,
-	routingKey string, mandatory, immediate bool, deliveryProperties DeliveryProperties, results chan *PublishResult) {
+	routingKey string, mandatory, immediate bool, deliveryProperties DeliveryProperties,
+	transforms Transformer, plugin *Plugin, results chan *PublishResult) {
 
 	var err error
 	var body []byte
 	var message *amqp.Publishing
-	var messages chan *amqp.Publishing
+	var messages chan *DeliveryPlus
 
-	messages = make(chan *amqp.Publishing)
+	messages = make(chan *DeliveryPlus)
+	published := make(chan bool)
 
-	go Publish(messages, connectionUri, exchange, routingKey, mandatory, immediate, results)
+	go func() {
+		Publish(messages, connectionUri, mandatory, immediate, results)
+		close(published)
+	}()
+
+	// once the last file is in, wait for its messages to be confirmed
+	defer func() {
+		close(messages)
+		<-published
+	}()
 
 	for file := range files {
 		if body, err = ioutil.ReadFile(file); err != nil {
@@ -37,19 +49,49 @@ func PublishFiles(files chan string, connectionUri, exchange,
 			message.ContentType = mime.TypeByExtension(filepath.Ext(file))
 		}
 
-		messages <- message
+		delivery := NewDeliveryPlus(exchange, routingKey, *message)
+		delivery.Data["File"] = file
+
+		if transforms != nil {
+			if err = transforms.Transform(delivery); err != nil {
+				results <- &PublishResult{"Failed to transform file " + file, err, false}
+				continue
+			}
+		}
+
+		if plugin == nil {
+			messages <- delivery
+			continue
+		}
+
+		outputs, err := plugin.Process(delivery)
+		if err != nil {
+			_, isPluginError := err.(*PluginError)
+			results <- &PublishResult{"Plugin failed on file " + file, err, !isPluginError}
+			continue
+		}
+		if len(outputs) == 0 {
+			results <- &PublishResult{"Plugin dropped file " + file, nil, false}
+			continue
+		}
+		for _, output := range outputs {
+			messages <- output
+		}
 	}
 }
 
-func Publish(messages chan *amqp.Publishing, connectionUri, exchange,
-	routingKey string, mandatory, immediate bool, results chan *PublishResult) {
+// confirmed counts the messages the broker has confirmed
+var confirmed int64
+
+// Publish publishes each message in confirm mode, waiting for the broker to
+// confirm each before publishing the next, until messages is closed
+func Publish(messages chan *DeliveryPlus, connectionUri string,
+	mandatory, immediate bool, results chan *PublishResult) {
 
 	var err error
 	var conn *amqp.Connection
 	var channel *amqp.Channel
 
-	defer close(results)
-
 	if conn, err = amqp.Dial(connectionUri); err != nil {
 		results <- &PublishResult{"Failed to connect", err, true}
 		return
@@ -73,8 +115,11 @@ func Publish(messages chan *amqp.Publishing, connectionUri, exchange,
 		return
 	}
 
-	for message := range messages {
-		err = channel.Publish(exchange, routingKey, mandatory, immediate, *message)
+	for delivery := range messages {
+		exchange, routingKey := delivery.RawDelivery.Exchange, delivery.RawDelivery.RoutingKey
+		message := delivery.Publishing()
+
+		err = channel.Publish(exchange, routingKey, mandatory, immediate, message)
 		if err != nil {
 			results <- &PublishResult{"Failed to publish message", err, false}
 			continue
@@ -84,6 +129,7 @@ func Publish(messages chan *amqp.Publishing, connectionUri, exchange,
 		case err = <-chanClose:
 			results <- &PublishResult{"Channel closed!", err, true}
 		case <-pubAcks:
+			atomic.AddInt64(&confirmed, 1)
 			results <- &PublishResult{
 				fmt.Sprintf("Published to exchange '%s' routing key '%v': %+v", exchange, routingKey, message),
 				nil,
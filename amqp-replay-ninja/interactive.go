@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	errSkipped = errors.New("skipped by operator")
+	errQuit    = errors.New("quit by operator")
+)
+
+// Reviewer shows each message to an operator on the controlling terminal and
+// asks whether to publish, skip or edit it before it is replayed.  The
+// terminal is used rather than stdin so that messages may still be piped in.
+type Reviewer struct {
+	tty    *os.File
+	in     *bufio.Reader
+	editor string
+}
+
+// NewReviewer opens the controlling terminal for an interactive review
+func NewReviewer() (*Reviewer, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if len(editor) == 0 {
+		editor = os.Getenv("EDITOR")
+	}
+	if len(editor) == 0 {
+		editor = "vi"
+	}
+
+	return &Reviewer{tty: tty, in: bufio.NewReader(tty), editor: editor}, nil
+}
+
+// Close releases the controlling terminal
+func (r *Reviewer) Close() error {
+	return r.tty.Close()
+}
+
+// Review returns the message to publish, which may have been edited, or
+// errSkipped or errQuit if the operator decided not to publish it.
+func (r *Reviewer) Review(msg *ErrorMessage) (*ErrorMessage, error) {
+	for {
+		r.show(msg)
+
+		switch r.prompt("[p]ublish, [s]kip, [e]dit, [q]uit? ") {
+		case "p", "publish":
+			return msg, nil
+		case "s", "skip":
+			return nil, errSkipped
+		case "q", "quit":
+			return nil, errQuit
+		case "e", "edit":
+			edited, err := r.edit(msg)
+			if err != nil {
+				fmt.Fprintf(r.tty, "Edit discarded: %s\n", err)
+				continue
+			}
+			msg = edited
+		}
+	}
+}
+
+func (r *Reviewer) prompt(question string) string {
+	fmt.Fprint(r.tty, question)
+	answer, err := r.in.ReadString('\n')
+	if err != nil {
+		return "q"
+	}
+	return strings.ToLower(strings.TrimSpace(answer))
+}
+
+func (r *Reviewer) show(msg *ErrorMessage) {
+	oMsg := msg.OriginalMessage
+	props := oMsg.Properties
+
+	fmt.Fprintln(r.tty, strings.Repeat("-", 72))
+	fmt.Fprintf(r.tty, "Exchange:         %s\n", oMsg.Exchange)
+	fmt.Fprintf(r.tty, "Routing key:      %s\n", oMsg.RoutingKey)
+	fmt.Fprintf(r.tty, "Message id:       %s\n", props.MessageId)
+	fmt.Fprintf(r.tty, "Correlation id:   %s\n", props.CorrelationId)
+	fmt.Fprintf(r.tty, "App id:           %s\n", props.AppId)
+	fmt.Fprintf(r.tty, "Content type:     %s\n", props.ContentType)
+	fmt.Fprintf(r.tty, "Content encoding: %s\n", props.ContentEncoding)
+	fmt.Fprintf(r.tty, "Delivery mode:    %d\n", props.DeliveryMode)
+	fmt.Fprintf(r.tty, "Timestamp:        %s\n", props.Timestamp)
+	if props.Headers != nil {
+		fmt.Fprintf(r.tty, "Headers:          %v\n", props.Headers)
+	}
+	fmt.Fprintln(r.tty)
+
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, []byte(oMsg.Payload), "", "  ") == nil {
+		fmt.Fprintln(r.tty, pretty.String())
+	} else {
+		fmt.Fprintln(r.tty, oMsg.Payload)
+	}
+	fmt.Fprintln(r.tty)
+}
+
+// edit opens the decoded message in the operator's editor and returns the
+// result once it has been validated
+func (r *Reviewer) edit(msg *ErrorMessage) (*ErrorMessage, error) {
+	jsonBytes, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile("", "amqp-replay-ninja-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(jsonBytes)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("sh", "-c", r.editor+` "$1"`, "--", file.Name())
+	cmd.Stdin = r.tty
+	cmd.Stdout = r.tty
+	cmd.Stderr = r.tty
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %s", r.editor, err)
+	}
+
+	jsonBytes, err = ioutil.ReadFile(file.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseErrorMessage(jsonBytes)
+}
+
+// ParseErrorMessage strictly decodes an error message, rejecting unknown
+// fields, and checks that it can still be replayed
+func ParseErrorMessage(jsonBytes []byte) (*ErrorMessage, error) {
+	msg := &ErrorMessage{}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	if err := decoder.Decode(msg); err != nil {
+		return nil, err
+	}
+
+	oMsg := msg.OriginalMessage
+	if len(oMsg.Exchange) == 0 && len(oMsg.RoutingKey) == 0 {
+		return nil, errors.New("original_message needs an exchange or a routing_key")
+	}
+	if oMsg.Properties.DeliveryMode < 0 || oMsg.Properties.DeliveryMode > 2 {
+		return nil, fmt.Errorf("invalid delivery_mode %d", oMsg.Properties.DeliveryMode)
+	}
+	if !*timeNow {
+		if _, err := time.Parse(timeFormat, oMsg.Properties.Timestamp); err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %s", err)
+		}
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// editedMessage is an error message as an operator might leave it in $EDITOR
+func editedMessage(exchange, routingKey, properties string) []byte {
+	return []byte(`{"original_message": {"payload": "{}", "exchange": "` + exchange +
+		`", "routing_key": "` + routingKey + `", "properties": {` + properties + `}}}`)
+}
+
+func TestParseErrorMessage(t *testing.T) {
+	saved := *timeNow
+	defer func() { *timeNow = saved }()
+	*timeNow = false
+
+	timestamp := `"timestamp": "Tue Sep 24 12:00:00 UTC 2013"`
+	msg, err := ParseErrorMessage(editedMessage("", "orders", `"delivery_mode": 2, "Headers": {"attempt": 3}, `+timestamp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oMsg := msg.OriginalMessage
+	if oMsg.RoutingKey != "orders" || oMsg.Properties.DeliveryMode != 2 || oMsg.Payload != "{}" {
+		t.Errorf("unexpected message %+v", oMsg)
+	}
+	if headers := headersTable(oMsg.Properties.Headers); headers["attempt"] != int64(3) {
+		t.Errorf("expected an integer header, got %#v", headers["attempt"])
+	}
+
+	for _, test := range []struct {
+		name     string
+		jsonText []byte
+		expected string
+	}{
+		{"unknown field", editedMessage("events", "", `"delivery_mod": 2, `+timestamp), "unknown field"},
+		{"misspelt message", []byte(`{"original_mesage": {}}`), "unknown field"},
+		{"nowhere to publish", editedMessage("", "", timestamp), "exchange or a routing_key"},
+		{"delivery mode too high", editedMessage("events", "", `"delivery_mode": 3, `+timestamp), "delivery_mode"},
+		{"delivery mode negative", editedMessage("events", "", `"delivery_mode": -1, `+timestamp), "delivery_mode"},
+		{"bad timestamp", editedMessage("events", "", `"timestamp": "yesterday"`), "timestamp"},
+		{"missing timestamp", editedMessage("events", "", ""), "timestamp"},
+		{"not JSON", []byte(`{"original_message":`), "EOF"},
+	} {
+		_, err := ParseErrorMessage(test.jsonText)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error mentioning '%s', got %v", test.name, test.expected, err)
+		}
+	}
+
+	// with -timenow the timestamp is replaced, so it need not parse
+	*timeNow = true
+	if _, err = ParseErrorMessage(editedMessage("events", "", `"timestamp": "yesterday"`)); err != nil {
+		t.Errorf("expected the timestamp to be ignored with -timenow, got %s", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+import (
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+const (
+	replayedAtHeader     = "x-replayed-at"
+	replayCountHeader    = "x-replay-count"
+	replaySourceHeader   = "x-replay-source"
+	replayOperatorHeader = "x-replay-operator"
+	replayHostHeader     = "x-replay-host"
+)
+
+// ReplayLimitError is returned when a message has already been replayed the
+// maximum number of times allowed by -max-replays
+type ReplayLimitError struct {
+	MessageId string
+	Count     int
+	Max       int
+}
+
+func (e *ReplayLimitError) Error() string {
+	return fmt.Sprintf("message '%s' has already been replayed %d time(s) (max %d)", e.MessageId, e.Count, e.Max)
+}
+
+// headersTable converts decoded JSON headers into an amqp.Table that passes
+// validation and replays integers as integers, giving an empty table when
+// there are no headers
+func headersTable(headers interface{}) amqp.Table {
+	table := amqptools.TableFromJSON(headers)
+	if table == nil {
+		table = amqp.Table{}
+	}
+	return table
+}
+
+// ReplayCount returns the number of times a message has been replayed
+// according to its x-replay-count header
+func ReplayCount(headers amqp.Table) int {
+	switch v := headers[replayCountHeader].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float32:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		count, err := strconv.Atoi(v)
+		if err == nil {
+			return count
+		}
+	}
+	return 0
+}
+
+// AddReplayLineage stamps the headers of a message about to be replayed with
+// where and when it was replayed, and by whom
+func AddReplayLineage(headers amqp.Table, source string) {
+	headers[replayCountHeader] = int32(ReplayCount(headers) + 1)
+	headers[replayedAtHeader] = time.Now().UTC().Format(time.RFC3339)
+	headers[replaySourceHeader] = source
+	headers[replayOperatorHeader] = operatorName()
+	headers[replayHostHeader] = hostName()
+}
+
+func operatorName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); len(name) > 0 {
+		return name
+	}
+	return "<unknown>"
+}
+
+func hostName() string {
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "<unknown>"
+}
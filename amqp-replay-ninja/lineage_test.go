@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func TestReplayCount(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected int
+	}{
+		{nil, 0},
+		{int32(2), 2},
+		{int64(3), 3},
+		{float64(4), 4},
+		{"5", 5},
+		{"five", 0},
+		{true, 0},
+	} {
+		headers := amqp.Table{}
+		if test.value != nil {
+			headers[replayCountHeader] = test.value
+		}
+		if count := ReplayCount(headers); count != test.expected {
+			t.Errorf("%#v: expected %d, got %d", test.value, test.expected, count)
+		}
+	}
+}
+
+func TestAddReplayLineage(t *testing.T) {
+	headers := amqp.Table{replayCountHeader: float64(1), "tenant": "acme"}
+	AddReplayLineage(headers, "errors/order.failed")
+
+	if headers[replayCountHeader] != int32(2) {
+		t.Errorf("expected the count to go up as an integer, got %#v", headers[replayCountHeader])
+	}
+	if headers[replaySourceHeader] != "errors/order.failed" || headers["tenant"] != "acme" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	for _, name := range []string{replayedAtHeader, replayOperatorHeader, replayHostHeader} {
+		if value, ok := headers[name].(string); !ok || len(value) == 0 {
+			t.Errorf("expected a %s header, got %#v", name, headers[name])
+		}
+	}
+	if err := headers.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHeadersTable(t *testing.T) {
+	errorMessage := &ErrorMessage{}
+	err := decodeJSON([]byte(`{"original_message": {"properties": {"Headers": {`+
+		`"x-replay-count": 2, "ratio": 0.5, "x-death": [{"count": 1, "queue": "orders"}]}}}}`), errorMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := headersTable(errorMessage.OriginalMessage.Properties.Headers)
+	if err = headers.Validate(); err != nil {
+		t.Fatalf("expected headers that can be published, got %s", err)
+	}
+	if headers[replayCountHeader] != int64(2) || headers["ratio"] != 0.5 {
+		t.Errorf("expected integers to stay integers, got %v", headers)
+	}
+	if death := headers["x-death"].([]interface{})[0].(amqp.Table); death["count"] != int64(1) {
+		t.Errorf("unexpected x-death %v", death)
+	}
+
+	// lineage is added to messages that had no headers at all
+	if headers = headersTable(nil); headers == nil || len(headers) != 0 {
+		t.Errorf("expected an empty table, got %#v", headers)
+	}
+}
+
+func TestCheckReplayLimit(t *testing.T) {
+	saved := *maxReplays
+	defer func() { *maxReplays = saved }()
+
+	for _, test := range []struct {
+		max      int
+		replayed int
+		// the count on the message about to be published, after its lineage
+		// was added and any transform or plugin had its way with it
+		published interface{}
+		refused   bool
+	}{
+		{0, 10, int32(11), false},
+		// a message's first replay
+		{1, 0, int32(1), false},
+		// its third, and then its fourth
+		{3, 2, int32(3), false},
+		{3, 3, int32(4), true},
+		// a transform or plugin can not lower the count to get around the limit
+		{3, 3, int32(1), true},
+		{3, 3, nil, true},
+		// but can raise it
+		{3, 0, "5", true},
+	} {
+		*maxReplays = test.max
+		output := amqptools.NewDeliveryPlus("", "orders", amqp.Publishing{MessageId: "abc", Headers: amqp.Table{}})
+		if test.published != nil {
+			output.RawDelivery.Headers[replayCountHeader] = test.published
+		}
+
+		err := checkReplayLimit(output, test.replayed)
+		if _, ok := err.(*ReplayLimitError); ok != test.refused {
+			t.Errorf("%+v: expected refused to be %t, got %v", test, test.refused, err)
+		}
+	}
+}
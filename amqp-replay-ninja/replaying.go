@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -14,6 +16,8 @@ import (
 
 const timeFormat = "Mon Jan 02 15:04:05 MST 2006"
 
+var errDropped = errors.New("dropped by plugin")
+
 type ErrorMessage struct {
 	OriginalMessage OriginalMessage `json:"original_message"`
 	OtherData       map[string]interface{}
@@ -36,17 +40,86 @@ type Properties struct {
 	Expiration      interface{}
 	Headers         interface{}
 	Priority        interface{}
-	Timestamp       string `json:"timestamp"`
+	ReplyTo         interface{} `json:"reply_to"`
+	Timestamp       string      `json:"timestamp"`
 	Type            interface{}
 	UserId          interface{}
 }
 
-func HandleMessageBytes(bytes []byte, channel *amqp.Channel, debugger amqptools.Debugger) {
+// errorMessageFromDelivery wraps a plain delivery, such as one decoded from
+// the firehose, as if it were an error message so that it can be replayed as
+// it is
+func errorMessageFromDelivery(delivery amqp.Delivery) *ErrorMessage {
+	var headers interface{}
+	if delivery.Headers != nil {
+		headers = map[string]interface{}(delivery.Headers)
+	}
+
+	return &ErrorMessage{
+		OriginalMessage: OriginalMessage{
+			Payload:    string(delivery.Body),
+			RoutingKey: delivery.RoutingKey,
+			Exchange:   delivery.Exchange,
+			Properties: Properties{
+				AppId:           delivery.AppId,
+				ContentType:     delivery.ContentType,
+				ContentEncoding: delivery.ContentEncoding,
+				CorrelationId:   delivery.CorrelationId,
+				MessageId:       delivery.MessageId,
+				DeliveryMode:    int(delivery.DeliveryMode),
+				Expiration:      delivery.Expiration,
+				Headers:         headers,
+				Priority:        int(delivery.Priority),
+				ReplyTo:         delivery.ReplyTo,
+				Timestamp:       delivery.Timestamp.UTC().Format(timeFormat),
+				Type:            delivery.Type,
+				UserId:          delivery.UserId,
+			},
+		},
+	}
+}
+
+// propertyString returns an optional string property, or "" if it is unset
+func propertyString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return ""
+}
+
+// propertyInt returns an optional numeric property, or 0 if it is unset
+func propertyInt(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return int(n)
+	}
+	return 0
+}
+
+// decodeJSON decodes JSON keeping numbers as json.Number, so that headersTable
+// can tell integers from floats
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// HandleMessageBytes republishes the original message wrapped in a consumed
+// error message. A *ReplayLimitError is returned, and nothing is published, if
+// the message has already been replayed -max-replays times. When reviewing
+// interactively, errSkipped and errQuit report the operator's decision, and
+// errDropped is returned when a plugin drops the message.
+func HandleMessageBytes(bytes []byte, channel *amqp.Channel, debugger amqptools.Debugger) error {
 	var err error
 
 	delivery := &amqptools.DeliveryPlus{}
 
-	err = json.Unmarshal(bytes, &delivery)
+	err = decodeJSON(bytes, &delivery)
 
 	if debugger.WithError(err, "Unable to unmarshal delivery into JSON: ", err) {
 		os.Exit(7)
@@ -59,15 +132,36 @@ func HandleMessageBytes(bytes []byte, channel *amqp.Channel, debugger amqptools.
 
 	errorMessage := &ErrorMessage{}
 
-	err = json.Unmarshal(bodyBytes, &errorMessage)
-	if debugger.WithError(err, "Unable to unmarshal delivery into JSON: ", err) {
-		os.Exit(7)
+	if *rawReplay || delivery.Data[amqptools.FirehoseEventKey] != nil {
+		errorMessage = errorMessageFromDelivery(rawDelivery)
+	} else {
+		err = decodeJSON(bodyBytes, &errorMessage)
+		if debugger.WithError(err, "Unable to unmarshal delivery into JSON: ", err) {
+			os.Exit(7)
+		}
 	}
 
-	oMsg := errorMessage.OriginalMessage
-
 	debugger.Print(fmt.Sprintf("consumed message: %+v", errorMessage.OriginalMessage))
 
+	headers := headersTable(errorMessage.OriginalMessage.Properties.Headers)
+
+	// refused here without troubling a reviewer, and checked again once the
+	// message is ready to publish
+	replayed := ReplayCount(headers)
+	if *maxReplays > 0 && replayed >= *maxReplays {
+		return &ReplayLimitError{errorMessage.OriginalMessage.Properties.MessageId, replayed, *maxReplays}
+	}
+
+	if reviewer != nil {
+		errorMessage, err = reviewer.Review(errorMessage)
+		if err != nil {
+			return err
+		}
+		headers = headersTable(errorMessage.OriginalMessage.Properties.Headers)
+	}
+
+	oMsg := errorMessage.OriginalMessage
+
 	var timestamp time.Time
 
 	if *timeNow {
@@ -79,19 +173,92 @@ func HandleMessageBytes(bytes []byte, channel *amqp.Channel, debugger amqptools.
 		}
 	}
 
-	msg := &amqp.Publishing{
-		ContentType:     oMsg.Properties.ContentType,
-		ContentEncoding: oMsg.Properties.ContentEncoding,
-		DeliveryMode:    uint8(oMsg.Properties.DeliveryMode),
-		CorrelationId:   oMsg.Properties.CorrelationId,
-		MessageId:       oMsg.Properties.MessageId,
-		Timestamp:       timestamp,
-		AppId:           oMsg.Properties.AppId,
-		Body:            []byte(oMsg.Payload),
+	AddReplayLineage(headers, replaySource(rawDelivery))
+
+	outgoing := &amqptools.DeliveryPlus{
+		RawDelivery: amqp.Delivery{
+			Headers:         headers,
+			ContentType:     oMsg.Properties.ContentType,
+			ContentEncoding: oMsg.Properties.ContentEncoding,
+			DeliveryMode:    uint8(oMsg.Properties.DeliveryMode),
+			CorrelationId:   oMsg.Properties.CorrelationId,
+			MessageId:       oMsg.Properties.MessageId,
+			Timestamp:       timestamp,
+			AppId:           oMsg.Properties.AppId,
+			Priority:        uint8(propertyInt(oMsg.Properties.Priority)),
+			ReplyTo:         propertyString(oMsg.Properties.ReplyTo),
+			Expiration:      propertyString(oMsg.Properties.Expiration),
+			Type:            propertyString(oMsg.Properties.Type),
+			Exchange:        oMsg.Exchange,
+			RoutingKey:      oMsg.RoutingKey,
+			Body:            []byte(oMsg.Payload),
+		},
+		Data: delivery.Data,
 	}
 
-	err = channel.Publish(oMsg.Exchange, oMsg.RoutingKey, true, false, *msg)
-	if debugger.WithError(err, "Unable to publish: ", err) {
-		os.Exit(19)
+	if messageTransforms != nil {
+		if err = messageTransforms.Transform(outgoing); err != nil {
+			return err
+		}
+	}
+
+	outputs := []*amqptools.DeliveryPlus{outgoing}
+
+	if plugin != nil {
+		outputs, err = plugin.Process(outgoing)
+		if _, ok := err.(*amqptools.PluginError); ok {
+			return err
+		}
+		if debugger.WithError(err, "Plugin failed: ", err) {
+			os.Exit(31)
+		}
+		if len(outputs) == 0 {
+			return errDropped
+		}
+	}
+
+	for _, output := range outputs {
+		if err = checkReplayLimit(output, replayed); err != nil {
+			return err
+		}
+	}
+
+	for _, output := range outputs {
+		err = channel.Publish(output.RawDelivery.Exchange, output.RawDelivery.RoutingKey, true, false, output.Publishing())
+		if debugger.WithError(err, "Unable to publish: ", err) {
+			os.Exit(19)
+		}
+	}
+	return nil
+}
+
+// checkReplayLimit refuses a message about to be published whose lineage
+// shows it has already been replayed -max-replays times.  An edit, transform
+// or plugin may have rewritten the lineage headers, so the count is taken
+// from the message as it is now, but never as less than replayed, the count
+// when it was read.
+func checkReplayLimit(output *amqptools.DeliveryPlus, replayed int) error {
+	if *maxReplays == 0 {
+		return nil
+	}
+
+	// the lineage already counts the replay about to happen
+	count := ReplayCount(output.RawDelivery.Headers) - 1
+	if count < replayed {
+		count = replayed
+	}
+	if count >= *maxReplays {
+		return &ReplayLimitError{output.RawDelivery.MessageId, count, *maxReplays}
+	}
+	return nil
+}
+
+// replaySource describes where the error message being replayed was consumed
+// from, in the same "exchange/routing-key" form used by amqp-consume-cat
+func replaySource(delivery amqp.Delivery) string {
+	exchange := delivery.Exchange
+	if len(exchange) == 0 {
+		exchange = "_"
 	}
+	return exchange + "/" + delivery.RoutingKey
 }
@@ -1,10 +1,13 @@
 package amqptools_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"testing"
 
 	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
 )
 
 func TestPublishFileResult(t *testing.T) {
@@ -22,3 +25,32 @@ func TestPublishFileResult(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTableFromJSON(t *testing.T) {
+	var decoded map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(`{"ttl": 60000, "ratio": 0.5, "tenant": "acme",` +
+		`"x-death": [{"count": 2, "queue": "orders"}], "nested": {"attempt": 1}}`)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	table := amqptools.TableFromJSON(decoded)
+	if err := table.Validate(); err != nil {
+		t.Fatalf("expected a valid table, got %s", err)
+	}
+	if table["ttl"] != int64(60000) || table["ratio"] != 0.5 || table["tenant"] != "acme" {
+		t.Errorf("unexpected values %v", table)
+	}
+	death := table["x-death"].([]interface{})[0].(amqp.Table)
+	if death["count"] != int64(2) || death["queue"] != "orders" {
+		t.Errorf("unexpected x-death %v", death)
+	}
+	if nested := table["nested"].(amqp.Table); nested["attempt"] != int64(1) {
+		t.Errorf("unexpected nested table %v", nested)
+	}
+
+	if amqptools.TableFromJSON(nil) != nil || amqptools.TableFromJSON("acme") != nil {
+		t.Error("expected anything but an object to give nil")
+	}
+}
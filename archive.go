@@ -0,0 +1,116 @@
+package amqptools
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/klauspost/compress/zstd"
+)
+
+// ReadArchive reads messages back in from what the dir and file sinks wrote,
+// calling handle for each in turn and stopping at the first error.  path may
+// be a message.json, an NDJSON segment, compressed or not, or a directory
+// holding any number of either.
+func ReadArchive(path string, handle func(*DeliveryPlus) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return readArchiveFile(path, handle)
+	}
+
+	return filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isArchiveFile(name) {
+			return nil
+		}
+		return readArchiveFile(name, handle)
+	})
+}
+
+// isArchiveFile picks out message files and NDJSON segments, leaving out
+// manifests, extracted bodies and partial writes.  Segments are named after
+// whatever path the file sink was given, so besides anything named .ndjson or
+// .jsonl, a <stem>-<number><ext> with a <stem>.manifest.ndjson beside it is a
+// segment, whether or not it was finished.
+func isArchiveFile(name string) bool {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") || strings.Contains(base, ".manifest.") {
+		return false
+	}
+	if base == messageFileName || strings.Contains(base, ".ndjson") || strings.Contains(base, ".jsonl") {
+		return true
+	}
+
+	stem := base
+	for _, ext := range compressionExtensions {
+		if len(ext) > 0 {
+			stem = strings.TrimSuffix(stem, ext)
+		}
+	}
+	stem = strings.TrimSuffix(stem, filepath.Ext(stem))
+	i := strings.LastIndex(stem, "-")
+	if i < 0 {
+		return false
+	}
+	if _, err := strconv.Atoi(stem[i+1:]); err != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(name), stem[:i]+".manifest.ndjson"))
+	return err == nil
+}
+
+func readArchiveFile(name string, handle func(*DeliveryPlus) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case strings.HasSuffix(name, ".zst"):
+		zstdReader, err := zstd.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	}
+
+	// a message.json is a single, possibly indented, message and a segment
+	// is one per line, both of which a decoder reads the same way.  Numbers
+	// are kept exact so that headers are read back as a table the broker
+	// accepts, with integers still integers.
+	decoder := json.NewDecoder(reader)
+	decoder.UseNumber()
+	for n := 1; decoder.More(); n++ {
+		var delivery DeliveryPlus
+		if err = decoder.Decode(&delivery); err != nil {
+			return fmt.Errorf("%s: message %d: %s", name, n, err)
+		}
+		delivery.RawDelivery.Headers = TableFromJSON(delivery.RawDelivery.Headers)
+		if err = handle(&delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
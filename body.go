@@ -0,0 +1,176 @@
+package amqptools
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// BodyFormats are the ways a message body may be rendered into a delivery's
+// Data.  "auto" picks one of the others from the content type and the body
+// itself.
+var BodyFormats = []string{"auto", "string", "json", "base64", "hex"}
+
+// bodyKeys are the Data keys a rendered body may be stored under, by format
+var bodyKeys = map[string]string{
+	"string": "BodyAsString",
+	"json":   "BodyAsJSON",
+	"base64": "BodyAsBase64",
+	"hex":    "BodyAsHex",
+}
+
+// RenderBody replaces any rendered body in a delivery's Data with one in the
+// given format.  Bodies with a gzip or deflate content encoding are
+// decompressed first, except in "string" format which is the body exactly as
+// it was received.  A body that can not be rendered as asked, e.g. "json" for
+// a body that is not JSON, is rendered as "auto" would and an error returned
+// saying why.
+func RenderBody(delivery *DeliveryPlus, format string) error {
+	if err := CheckBodyFormat(format); err != nil {
+		return err
+	}
+
+	if delivery.Data == nil {
+		delivery.Data = make(map[string]interface{})
+	}
+	for _, key := range bodyKeys {
+		delete(delivery.Data, key)
+	}
+
+	raw := delivery.RawDelivery.Body
+	if format == "string" {
+		delivery.Data[bodyKeys["string"]] = string(raw)
+		return nil
+	}
+
+	body, err := DecodeContentEncoding(raw, delivery.RawDelivery.ContentEncoding)
+	if err != nil {
+		// show what was actually received
+		body = raw
+	}
+
+	var renderErr error
+	if format == "json" && !json.Valid(body) {
+		renderErr = fmt.Errorf("body of message '%s' is not JSON", delivery.RawDelivery.MessageId)
+		format = "auto"
+	}
+	if format == "auto" {
+		format = detectBodyFormat(delivery.RawDelivery.ContentType, body)
+	}
+
+	var value interface{}
+	switch format {
+	case "json":
+		value = json.RawMessage(body)
+	case "string":
+		value = string(body)
+	case "base64":
+		value = base64.StdEncoding.EncodeToString(body)
+	case "hex":
+		value = hex.Dump(body)
+	}
+	delivery.Data[bodyKeys[format]] = value
+
+	if err != nil {
+		return err
+	}
+	return renderErr
+}
+
+// CheckBodyFormat returns an error if format is not one of BodyFormats
+func CheckBodyFormat(format string) error {
+	if _, ok := bodyKeys[format]; !ok && format != "auto" {
+		return fmt.Errorf("unknown body format '%s', expected one of: %s", format, strings.Join(BodyFormats, ", "))
+	}
+	return nil
+}
+
+// DecodeContentEncoding decompresses a body with a gzip or deflate content
+// encoding.  Bodies with no or any other content encoding are returned as
+// they are.
+func DecodeContentEncoding(body []byte, contentEncoding string) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// HTTP's deflate is zlib wrapped, but raw deflate is common enough
+		if reader, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return body, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s body: %s", contentEncoding, err)
+	}
+	defer reader.Close()
+
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s body: %s", contentEncoding, err)
+	}
+	return decoded, nil
+}
+
+// detectBodyFormat picks json for JSON content types whose bodies are valid
+// JSON, string for text, and base64 for everything else
+func detectBodyFormat(contentType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		if json.Valid(body) {
+			return "json"
+		}
+	case len(mediaType) == 0 && json.Valid(body) && len(bytes.TrimSpace(body)) > 0:
+		if first := bytes.TrimSpace(body)[0]; first == '{' || first == '[' {
+			return "json"
+		}
+	}
+
+	if isText(mediaType, body) {
+		return "string"
+	}
+	return "base64"
+}
+
+// textTypes are non text/* content types whose bodies are text
+var textTypes = map[string]bool{
+	"application/xml":                   true,
+	"application/javascript":            true,
+	"application/x-www-form-urlencoded": true,
+	"application/yaml":                  true,
+}
+
+// isText reports whether a body is text.  A declared content type is trusted,
+// and a body without one is text if it is printable UTF-8.
+func isText(mediaType string, body []byte) bool {
+	if len(mediaType) > 0 {
+		textual := strings.HasPrefix(mediaType, "text/") || textTypes[mediaType] || strings.HasSuffix(mediaType, "+xml")
+		return textual && utf8.Valid(body)
+	}
+
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, r := range string(body) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package amqptools_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func renderedData(t *testing.T, msg amqp.Publishing, format string) map[string]interface{} {
+	delivery := amqptools.NewDeliveryPlus("events", "order.created", msg)
+	if err := amqptools.RenderBody(delivery, format); err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip through JSON, as the sinks would write it
+	jsonBytes, err := json.Marshal(delivery.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]interface{}
+	json.Unmarshal(jsonBytes, &data)
+	return data
+}
+
+func TestRenderBodyAutoEmbedsJSON(t *testing.T) {
+	data := renderedData(t, amqp.Publishing{ContentType: "application/json", Body: []byte(`{"id": 1}`)}, "auto")
+
+	object, ok := data["BodyAsJSON"].(map[string]interface{})
+	if !ok || object["id"] != float64(1) {
+		t.Errorf("expected an embedded JSON object, got %v", data)
+	}
+	if _, ok = data["BodyAsString"]; ok {
+		t.Error("expected no BodyAsString")
+	}
+}
+
+func TestRenderBodyAutoDecompressesGzip(t *testing.T) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte("hello, world"))
+	writer.Close()
+
+	data := renderedData(t, amqp.Publishing{ContentType: "text/plain", ContentEncoding: "gzip", Body: buf.Bytes()}, "auto")
+	if data["BodyAsString"] != "hello, world" {
+		t.Errorf("expected decompressed text, got %v", data)
+	}
+}
+
+func TestRenderBodyAutoEncodesBinary(t *testing.T) {
+	data := renderedData(t, amqp.Publishing{Body: []byte{0xff, 0x00, 0x10}}, "auto")
+	if data["BodyAsBase64"] != "/wAQ" {
+		t.Errorf("expected base64, got %v", data)
+	}
+
+	data = renderedData(t, amqp.Publishing{Body: []byte{0xff, 0x00, 0x10}}, "hex")
+	if hexdump, _ := data["BodyAsHex"].(string); !strings.HasPrefix(hexdump, "00000000  ff 00 10") {
+		t.Errorf("expected a hexdump, got %v", data)
+	}
+}
+
+func TestRenderBodyJSONFallsBack(t *testing.T) {
+	delivery := amqptools.NewDeliveryPlus("", "", amqp.Publishing{Body: []byte("not json")})
+	if err := amqptools.RenderBody(delivery, "json"); err == nil {
+		t.Error("expected an error for a body that is not JSON")
+	}
+	if delivery.Data["BodyAsString"] != "not json" {
+		t.Errorf("expected a fallback to text, got %v", delivery.Data)
+	}
+
+	if err := amqptools.RenderBody(delivery, "yaml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,182 @@
+package amqptools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultColumns are the columns of a table when none are given
+const DefaultColumns = "Timestamp,Exchange,RoutingKey,MessageId,ContentType,size,body"
+
+// deliveryFields are the amqp.Delivery fields a column may name, besides the
+// message properties
+var deliveryFields = []string{"DeliveryTag", "Redelivered", "ConsumerTag"}
+
+// Column is a single column of a table of messages, named as in ParseColumns
+type Column struct {
+	Name  string
+	value func(row *columnRow) interface{}
+}
+
+// columnRow is a message being laid out as a row, which decodes its JSON body
+// at most once however many columns look into it
+type columnRow struct {
+	delivery *DeliveryPlus
+	now      time.Time
+
+	decoded bool
+	json    interface{}
+}
+
+func (row *columnRow) body() interface{} {
+	if !row.decoded {
+		row.decoded = true
+		body, err := DecodeContentEncoding(row.delivery.RawDelivery.Body, row.delivery.RawDelivery.ContentEncoding)
+		if err == nil {
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			decoder.Decode(&row.json)
+		}
+	}
+	return row.json
+}
+
+// ParseColumns parses a comma separated list of columns.  A column may be
+//
+//   - a property or delivery field, e.g. RoutingKey or Redelivered
+//   - a header, as headers.<name>
+//   - a path into a JSON body, as body.<key>.<key>, where keys that are
+//     numbers index arrays, e.g. body.items.0.sku
+//   - body, for the whole body as rendered by RenderBody
+//   - size, for the size of the body in bytes
+//   - age, for the seconds since the message's timestamp
+func ParseColumns(spec string) ([]Column, error) {
+	var columns []Column
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		column, err := parseColumn(name)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns given in '%s'", spec)
+	}
+	return columns, nil
+}
+
+func parseColumn(name string) (Column, error) {
+	column := Column{Name: name}
+
+	switch {
+	case name == "body":
+		column.value = func(row *columnRow) interface{} {
+			return renderedBody(row.delivery)
+		}
+	case name == "size":
+		column.value = func(row *columnRow) interface{} {
+			return len(row.delivery.RawDelivery.Body)
+		}
+	case name == "age":
+		column.value = func(row *columnRow) interface{} {
+			timestamp := row.delivery.RawDelivery.Timestamp
+			if timestamp.IsZero() {
+				return nil
+			}
+			return strconv.FormatFloat(row.now.Sub(timestamp).Seconds(), 'f', 3, 64)
+		}
+	case strings.HasPrefix(name, "headers."):
+		header := strings.TrimPrefix(name, "headers.")
+		column.value = func(row *columnRow) interface{} {
+			return row.delivery.RawDelivery.Headers[header]
+		}
+	case strings.HasPrefix(name, "body."):
+		path := strings.Split(strings.TrimPrefix(name, "body."), ".")
+		column.value = func(row *columnRow) interface{} {
+			return jsonPath(row.body(), path)
+		}
+	default:
+		field, ok := deliveryField(name)
+		if !ok {
+			return column, fmt.Errorf("unknown column '%s'", name)
+		}
+		column.value = func(row *columnRow) interface{} {
+			return reflect.ValueOf(row.delivery.RawDelivery).FieldByName(field).Interface()
+		}
+	}
+	return column, nil
+}
+
+// deliveryField finds the amqp.Delivery field a column names, ignoring case
+func deliveryField(name string) (string, bool) {
+	for _, field := range append(propertyNames, deliveryFields...) {
+		if strings.EqualFold(name, field) {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// jsonPath follows keys into a decoded JSON value, returning nil if any of
+// them are missing
+func jsonPath(value interface{}, path []string) interface{} {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// Values lays a message out as a row of cells, one per column.  Times are
+// written as RFC3339, objects and arrays as JSON and missing values as empty
+// cells.
+func Values(columns []Column, delivery *DeliveryPlus) []string {
+	row := &columnRow{delivery: delivery, now: time.Now()}
+	cells := make([]string, len(columns))
+	for i, column := range columns {
+		cells[i] = formatCell(column.value(row))
+	}
+	return cells
+}
+
+func formatCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Map, reflect.Slice:
+		jsonBytes, _ := json.Marshal(value)
+		return string(jsonBytes)
+	}
+	return fmt.Sprint(value)
+}
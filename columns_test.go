@@ -0,0 +1,94 @@
+package amqptools_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func TestValuesForColumns(t *testing.T) {
+	columns, err := amqptools.ParseColumns("routingkey, headers.x-tenant, body.items.1.sku, body.missing, size, Timestamp, Redelivered")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := amqptools.NewDeliveryPlus("events", "order.created", amqp.Publishing{
+		Headers:   amqp.Table{"x-tenant": "acme"},
+		Timestamp: time.Date(2013, 9, 24, 12, 0, 0, 0, time.UTC),
+		Body:      []byte(`{"items": [{"sku": "a"}, {"sku": 12345678901234567890}]}`),
+	})
+
+	expected := []string{"order.created", "acme", "12345678901234567890", "", "56", "2013-09-24T12:00:00Z", "false"}
+	if cells := amqptools.Values(columns, delivery); !reflect.DeepEqual(cells, expected) {
+		t.Errorf("expected %q, got %q", expected, cells)
+	}
+
+	if _, err = amqptools.ParseColumns("RoutingKey,Colour"); err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+}
+
+func TestTableSinkQuotes(t *testing.T) {
+	columns, _ := amqptools.ParseColumns("MessageId,body")
+
+	var buf bytes.Buffer
+	sink, err := amqptools.NewTableSink(&buf, "csv", columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := amqptools.NewDeliveryPlus("", "", amqp.Publishing{MessageId: "a,b", Body: []byte("say \"hi\"\nbye")})
+	amqptools.RenderBody(delivery, "string")
+	if err = sink.Write(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"MessageId", "body"}, {"a,b", "say \"hi\"\nbye"}}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %q, got %q", expected, records)
+	}
+}
+
+func TestReadArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqptools-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sinks := []amqptools.Sink{
+		&amqptools.DirectorySink{Path: filepath.Join(dir, "tree"), Pretty: true},
+		&amqptools.NDJSONSink{Path: filepath.Join(dir, "segments", "messages.ndjson"), Compression: "zstd"},
+	}
+	for _, sink := range sinks {
+		for _, id := range []string{"one", "two"} {
+			if err = sink.Write(testDelivery(id, "{}")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sink.Close()
+	}
+
+	var ids []string
+	err = amqptools.ReadArchive(dir, func(delivery *amqptools.DeliveryPlus) error {
+		ids = append(ids, delivery.RawDelivery.MessageId)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"one", "two", "one", "two"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, got %v", expected, ids)
+	}
+}
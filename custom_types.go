@@ -1,12 +1,109 @@
 package amqptools
 
-import "github.com/streadway/amqp"
+import (
+	"encoding/json"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
 
 type DeliveryPlus struct {
 	RawDelivery amqp.Delivery
 	Data        map[string]interface{}
 }
 
+// NewDeliveryPlus wraps a message about to be published, along with where it
+// is going, so that it can be transformed before it is published
+func NewDeliveryPlus(exchange, routingKey string, msg amqp.Publishing) *DeliveryPlus {
+	return &DeliveryPlus{
+		RawDelivery: amqp.Delivery{
+			Headers:         msg.Headers,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Exchange:        exchange,
+			RoutingKey:      routingKey,
+			Body:            msg.Body,
+		},
+		Data: make(map[string]interface{}),
+	}
+}
+
+// Publishing returns the properties and body of the delivery ready to be
+// published again
+func (dp *DeliveryPlus) Publishing() amqp.Publishing {
+	d := dp.RawDelivery
+	return amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// TableFromJSON converts headers or arguments decoded from JSON with
+// UseNumber into an amqp.Table.  Nested objects become tables, so that the
+// table passes validation, and whole numbers become integers rather than
+// doubles.  Anything but an object gives nil.
+func TableFromJSON(value interface{}) amqp.Table {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return nil
+		}
+		table := amqp.Table{}
+		for key, val := range v {
+			table[key] = FieldFromJSON(val)
+		}
+		return table
+	case amqp.Table:
+		return TableFromJSON(map[string]interface{}(v))
+	}
+	return nil
+}
+
+// FieldFromJSON converts a single value decoded from JSON with UseNumber into
+// a value that can be sent in an amqp.Table
+func FieldFromJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}, amqp.Table:
+		return TableFromJSON(v)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, val := range v {
+			list[i] = FieldFromJSON(val)
+		}
+		return list
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
 type PublishResult struct {
 	Message string
 	Error   error
@@ -0,0 +1,328 @@
+package amqptools
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+const (
+	messageFileName = "message.json"
+	tempFileSuffix  = ".tmp"
+)
+
+// DefaultPathTemplate lays messages out as <exchange>/<message id>, filing
+// messages without a message id under the SHA1 of their JSON
+const DefaultPathTemplate = `{{or .Exchange "_"}}/{{or .MessageId .SHA1}}`
+
+// PathContext is the data made available to path templates, which is that of
+// message templates plus the SHA1 of the message's JSON
+type PathContext struct {
+	*TemplateContext
+	SHA1 string
+}
+
+// DirectorySink writes each message to its own message.json, in a directory
+// under Path given by PathTemplate, or DefaultPathTemplate if it is nil.  If
+// ExtractBody is true the raw body is written beside it as body.<ext>, with
+// the extension taken from the message's content type.  Each file is written
+// atomically and synced to disk, along with any directories created for it,
+// before Write returns.
+type DirectorySink struct {
+	Path         string
+	Pretty       bool
+	PathTemplate *template.Template
+	ExtractBody  bool
+}
+
+func (s *DirectorySink) Write(deliveryPlus *DeliveryPlus) error {
+	jsonBytes, err := MarshalDelivery(deliveryPlus, s.Pretty)
+	if err != nil {
+		return fmt.Errorf("unable to marshal delivery into JSON: %s", err)
+	}
+
+	relPath, err := messagePath(s.PathTemplate, deliveryPlus, jsonBytes)
+	if err != nil {
+		return err
+	}
+	fullPath := filepath.Join(s.Path, relPath)
+
+	if err = makeMessageDir(s.Path, relPath); err != nil {
+		return fmt.Errorf("unable to create output directory '%s': %s", fullPath, err)
+	}
+
+	// the body goes first, so that a complete message.json always has its body
+	if s.ExtractBody {
+		bodyName := filepath.Join(fullPath, bodyFileName(deliveryPlus.RawDelivery))
+		if err = writeFileAtomically(bodyName, deliveryPlus.RawDelivery.Body); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomically(filepath.Join(fullPath, messageFileName), jsonBytes)
+}
+
+// messagePath renders the directory a message is filed under, relative to the
+// output directory.  An empty path component, e.g. from {{.MessageId}} for a
+// message without one, is replaced with the SHA1 of the message's JSON, so
+// that such messages do not all share a directory and overwrite each other.
+func messagePath(pathTemplate *template.Template, deliveryPlus *DeliveryPlus, jsonBytes []byte) (string, error) {
+	if pathTemplate == nil {
+		pathTemplate = defaultPathTemplate
+	}
+
+	ctx := &PathContext{NewTemplateContext(deliveryPlus), fmt.Sprintf("%x", sha1.Sum(jsonBytes))}
+	rendered, err := executeTemplate(pathTemplate, ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to render path template: %s", err)
+	}
+
+	components := strings.Split(strings.TrimSpace(rendered), "/")
+	for i, component := range components {
+		if len(strings.TrimSpace(component)) == 0 {
+			components[i] = ctx.SHA1
+		}
+	}
+
+	relPath := filepath.Clean(filepath.Join(components...))
+	if filepath.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("path template rendered '%s', which is outside the output directory", rendered)
+	}
+	return relPath, nil
+}
+
+var defaultPathTemplate = template.Must(NewTemplate("path", DefaultPathTemplate))
+
+// makeMessageDir creates the directory a message is filed under one level at
+// a time, syncing the parent of each directory it creates so that the new
+// entries survive a crash along with the files later written into them
+func makeMessageDir(root, relPath string) error {
+	if err := os.MkdirAll(root, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	dir := root
+	for _, name := range strings.Split(relPath, string(os.PathSeparator)) {
+		if name == "." {
+			continue
+		}
+		parent := dir
+		dir = filepath.Join(dir, name)
+
+		err := os.Mkdir(dir, os.ModeDir|os.ModePerm)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = syncDir(parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir syncs a directory, so that the entries in it survive a crash
+func syncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open directory '%s': %s", dir, err)
+	}
+	err = dirFile.Sync()
+	dirFile.Close()
+	if err != nil {
+		return fmt.Errorf("unable to sync directory '%s': %s", dir, err)
+	}
+	return nil
+}
+
+// preferredExtensions are used ahead of the mime package, which may know of
+// several extensions for a type or none at all depending on the system
+var preferredExtensions = map[string]string{
+	"application/json":         ".json",
+	"application/xml":          ".xml",
+	"text/xml":                 ".xml",
+	"text/plain":               ".txt",
+	"text/html":                ".html",
+	"text/csv":                 ".csv",
+	"application/x-protobuf":   ".pb",
+	"application/protobuf":     ".pb",
+	"application/msgpack":      ".msgpack",
+	"application/x-msgpack":    ".msgpack",
+	"application/octet-stream": ".bin",
+}
+
+// bodyFileName names the file a message's raw body is extracted to, e.g.
+// body.json for application/json or body.json.gz if it is also gzip encoded
+func bodyFileName(delivery amqp.Delivery) string {
+	ext := ".bin"
+	if mediaType, _, err := mime.ParseMediaType(delivery.ContentType); err == nil {
+		if preferred, ok := preferredExtensions[mediaType]; ok {
+			ext = preferred
+		} else if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+
+	switch delivery.ContentEncoding {
+	case "gzip":
+		ext += ".gz"
+	case "deflate":
+		ext += ".zz"
+	}
+	return "body" + ext
+}
+
+// writeFileAtomically writes data to a temporary file beside fileName, syncs
+// it and renames it into place, then syncs the directory so that the rename
+// itself survives a crash.  fileName is either complete or missing, never
+// truncated.
+func writeFileAtomically(fileName string, data []byte) error {
+	dir := filepath.Dir(fileName)
+
+	file, err := ioutil.TempFile(dir, "."+filepath.Base(fileName)+".*"+tempFileSuffix)
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file in '%s': %s", dir, err)
+	}
+	tempName := file.Name()
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return fmt.Errorf("unable to write data into '%s': %s", tempName, err)
+	}
+
+	if err = os.Rename(tempName, fileName); err != nil {
+		os.Remove(tempName)
+		return fmt.Errorf("unable to rename '%s' to '%s': %s", tempName, fileName, err)
+	}
+
+	return syncDir(dir)
+}
+
+// VerifyProblem is a message file in an output directory that is incomplete
+// or does not match where it is filed
+type VerifyProblem struct {
+	Path   string
+	Reason string
+}
+
+func (p VerifyProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Reason)
+}
+
+// VerifyDirectory scans a directory written by DirectorySink for leftover
+// temporary files from interrupted writes, message files that are empty or
+// not valid JSON, message files that are not where pathTemplate would file
+// them, and extracted bodies that do not match their message.  A nil
+// pathTemplate means DefaultPathTemplate.
+func VerifyDirectory(path string, pathTemplate *template.Template) ([]VerifyProblem, error) {
+	var problems []VerifyProblem
+
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), ".") && strings.HasSuffix(info.Name(), tempFileSuffix) {
+			problems = append(problems, VerifyProblem{name, "partial write left behind by an interrupted consumer"})
+			return nil
+		}
+		if info.Name() != messageFileName {
+			return nil
+		}
+
+		if reason := verifyMessageFile(path, name, pathTemplate); len(reason) > 0 {
+			problems = append(problems, VerifyProblem{name, reason})
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// verifyMessageFile checks a single message.json, returning why it is bad or
+// an empty string if it is fine
+func verifyMessageFile(root, name string, pathTemplate *template.Template) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err.Error()
+	}
+	if len(data) == 0 {
+		return "empty file"
+	}
+
+	var deliveryPlus DeliveryPlus
+	if err = json.Unmarshal(data, &deliveryPlus); err != nil {
+		return fmt.Sprintf("invalid JSON: %s", err)
+	}
+
+	dir := filepath.Dir(name)
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return err.Error()
+	}
+	expected, err := messagePath(pathTemplate, &deliveryPlus, data)
+	if err != nil {
+		return err.Error()
+	}
+	if rel != expected {
+		return fmt.Sprintf("filed under '%s' but belongs under '%s'", rel, expected)
+	}
+
+	bodies, _ := filepath.Glob(filepath.Join(dir, "body.*"))
+	for _, bodyName := range bodies {
+		body, err := ioutil.ReadFile(bodyName)
+		if err != nil {
+			return err.Error()
+		}
+		if !bytes.Equal(body, deliveryPlus.RawDelivery.Body) {
+			return fmt.Sprintf("extracted body %s does not match the message body", filepath.Base(bodyName))
+		}
+	}
+	return ""
+}
+
+func (s *DirectorySink) Close() error {
+	return nil
+}
+
+func init() {
+	// dir:<path>[?pretty=true&path-template=...&extract-body=true]
+	RegisterSink("dir", func(u *url.URL) (Sink, error) {
+		query := u.Query()
+		s := &DirectorySink{
+			Path:        sinkPath(u),
+			Pretty:      query.Get("pretty") == "true",
+			ExtractBody: query.Get("extract-body") == "true",
+		}
+		if text := query.Get("path-template"); len(text) > 0 {
+			var err error
+			if s.PathTemplate, err = NewTemplate("path", text); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	})
+}
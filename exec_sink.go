@@ -0,0 +1,222 @@
+package amqptools
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// DefaultRequeueCode is the exit status that asks ExecSink to requeue a
+// message, EX_TEMPFAIL from sysexits.h
+const DefaultRequeueCode = 75
+
+// ExecSink runs a shell command for each message, with the message's body on
+// its stdin, or its JSON if JSON is true, and its properties in environment
+// variables as described by MessageEnv.  The message has been handled once
+// the command exits 0.  Exiting with RequeueCode asks for the message to be
+// requeued, while any other exit status, or running for longer than Timeout,
+// rejects it with a RejectError.  A command that can not be started or is
+// killed by a signal leaves the message to be requeued.  The command's stderr is logged a
+// line at a time, prefixed with the message id.
+type ExecSink struct {
+	Command     string
+	RequeueCode int
+	Timeout     time.Duration
+	JSON        bool
+}
+
+func (s *ExecSink) Write(delivery *DeliveryPlus) error {
+	stdin := delivery.RawDelivery.Body
+	if s.JSON {
+		jsonBytes, err := MarshalDelivery(delivery, false)
+		if err != nil {
+			return err
+		}
+		stdin = jsonBytes
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", s.Command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), MessageEnv(delivery.RawDelivery)...)
+	// a group of its own, so that a timeout kills whatever the shell started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// failing to start, e.g. with fork/exec EAGAIN, says nothing about the
+	// message, so it is requeued to be tried again
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start '%s': %s", s.Command, err)
+	}
+
+	timedOut := make(chan bool, 1)
+	if s.Timeout > 0 {
+		timer := time.AfterFunc(s.Timeout, func() {
+			timedOut <- true
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+
+	err := cmd.Wait()
+	logStderr(delivery.RawDelivery.MessageId, &stderr)
+	if err == nil {
+		return nil
+	}
+
+	select {
+	case <-timedOut:
+		return &RejectError{fmt.Errorf("'%s' timed out after %s", s.Command, s.Timeout)}
+	default:
+	}
+
+	// only the command's own verdict rejects a message; being killed by
+	// someone else is treated like failing to start
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return fmt.Errorf("'%s' failed: %s", s.Command, err)
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	switch {
+	case !ok || !status.Exited():
+		return fmt.Errorf("'%s' failed: %s", s.Command, err)
+	case status.ExitStatus() == s.RequeueCode:
+		return fmt.Errorf("'%s' asked for a requeue", s.Command)
+	}
+	return &RejectError{fmt.Errorf("'%s' failed: %s", s.Command, err)}
+}
+
+func (s *ExecSink) ConcurrentWrites() bool {
+	return true
+}
+
+func (s *ExecSink) Close() error {
+	return nil
+}
+
+func logStderr(messageId string, stderr *bytes.Buffer) {
+	if len(messageId) == 0 {
+		messageId = "-"
+	}
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Printf("[%s] %s", messageId, scanner.Text())
+	}
+}
+
+// MessageEnv describes a message in environment variables: AMQP_EXCHANGE,
+// AMQP_ROUTING_KEY, AMQP_REDELIVERED, one for each property, e.g.
+// AMQP_MESSAGE_ID and AMQP_CONTENT_TYPE, and one for each header, e.g.
+// AMQP_HEADER_X_TENANT for x-tenant.  Properties that are not set are left
+// out.
+func MessageEnv(delivery amqp.Delivery) []string {
+	var env []string
+	add := func(name, value string) {
+		if len(value) > 0 {
+			env = append(env, "AMQP_"+name+"="+value)
+		}
+	}
+
+	add("EXCHANGE", delivery.Exchange)
+	add("ROUTING_KEY", delivery.RoutingKey)
+	add("REDELIVERED", strconv.FormatBool(delivery.Redelivered))
+	add("CONTENT_TYPE", delivery.ContentType)
+	add("CONTENT_ENCODING", delivery.ContentEncoding)
+	if delivery.DeliveryMode > 0 {
+		add("DELIVERY_MODE", strconv.Itoa(int(delivery.DeliveryMode)))
+	}
+	if delivery.Priority > 0 {
+		add("PRIORITY", strconv.Itoa(int(delivery.Priority)))
+	}
+	add("CORRELATION_ID", delivery.CorrelationId)
+	add("REPLY_TO", delivery.ReplyTo)
+	add("EXPIRATION", delivery.Expiration)
+	add("MESSAGE_ID", delivery.MessageId)
+	if !delivery.Timestamp.IsZero() {
+		add("TIMESTAMP", delivery.Timestamp.UTC().Format(time.RFC3339))
+	}
+	add("TYPE", delivery.Type)
+	add("USER_ID", delivery.UserId)
+	add("APP_ID", delivery.AppId)
+
+	for name, value := range delivery.Headers {
+		add("HEADER_"+envName(name), formatCell(value))
+	}
+	return env
+}
+
+// envName upper cases a header name and replaces anything that can not be
+// in an environment variable name with an underscore
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func init() {
+	// exec:<shell command>[?requeue-code=75&timeout=30s&stdin=json]
+	//
+	// Everything after "exec:" is the command, so the options are only
+	// looked for after its last "?"
+	RegisterSink("exec", func(u *url.URL) (Sink, error) {
+		s := &ExecSink{Command: u.Opaque, RequeueCode: DefaultRequeueCode}
+
+		if i := strings.LastIndex(s.Command, "?"); i >= 0 {
+			if query, err := url.ParseQuery(s.Command[i+1:]); err == nil && isExecQuery(query) {
+				s.Command = s.Command[:i]
+				if value := query.Get("requeue-code"); len(value) > 0 {
+					if s.RequeueCode, err = strconv.Atoi(value); err != nil {
+						return nil, fmt.Errorf("invalid requeue-code '%s'", value)
+					}
+				}
+				if value := query.Get("timeout"); len(value) > 0 {
+					if s.Timeout, err = time.ParseDuration(value); err != nil {
+						return nil, err
+					}
+				}
+				s.JSON = query.Get("stdin") == "json"
+			}
+		}
+
+		if len(s.Command) == 0 {
+			return nil, errors.New("exec sink requires a command, e.g. \"exec:./handle-message.sh\"")
+		}
+		return s, nil
+	})
+}
+
+// isExecQuery reports whether a query holds only exec sink options, so that
+// a "?" that is part of the command is left alone
+func isExecQuery(query url.Values) bool {
+	if len(query) == 0 {
+		return false
+	}
+	for name := range query {
+		switch name {
+		case "requeue-code", "timeout", "stdin":
+		default:
+			return false
+		}
+	}
+	return true
+}
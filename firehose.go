@@ -0,0 +1,109 @@
+package amqptools
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+const (
+	// FirehoseExchange is the exchange RabbitMQ's firehose tracer publishes to
+	FirehoseExchange = "amq.rabbitmq.trace"
+
+	// Keys of the annotations added to DeliveryPlus.Data by DecodeFirehose
+	FirehoseEventKey = "FirehoseEvent"
+	FirehoseNodeKey  = "FirehoseNode"
+	FirehoseQueueKey = "FirehoseQueue"
+)
+
+// DecodeFirehose unwraps a firehose trace event into the message it traced.
+// Trace events are routed as "publish.<exchange>" or "deliver.<queue>" and
+// carry the original routing and properties in their headers.  The result is
+// annotated with the event type, the node that traced it and, for deliver
+// events, the queue the message was delivered from.
+func DecodeFirehose(event amqp.Delivery) (*DeliveryPlus, error) {
+	parts := strings.SplitN(event.RoutingKey, ".", 2)
+	if len(parts) != 2 || (parts[0] != "publish" && parts[0] != "deliver") {
+		return nil, errors.New("not a firehose trace event: routing key '" + event.RoutingKey + "'")
+	}
+
+	exchange, ok := event.Headers["exchange_name"].(string)
+	if !ok {
+		return nil, errors.New("firehose trace event has no exchange_name header")
+	}
+
+	delivery := amqp.Delivery{
+		Exchange:    exchange,
+		Body:        event.Body,
+		DeliveryTag: event.DeliveryTag,
+	}
+
+	if keys, ok := event.Headers["routing_keys"].([]interface{}); ok && len(keys) > 0 {
+		delivery.RoutingKey, _ = keys[0].(string)
+	}
+	if redelivered, ok := event.Headers["redelivered"]; ok {
+		delivery.Redelivered = firehoseInt(redelivered) != 0
+	}
+
+	if props, ok := event.Headers["properties"].(amqp.Table); ok {
+		if headers, ok := props["headers"].(amqp.Table); ok {
+			delivery.Headers = headers
+		}
+		delivery.ContentType, _ = props["content_type"].(string)
+		delivery.ContentEncoding, _ = props["content_encoding"].(string)
+		delivery.DeliveryMode = uint8(firehoseInt(props["delivery_mode"]))
+		delivery.Priority = uint8(firehoseInt(props["priority"]))
+		delivery.CorrelationId, _ = props["correlation_id"].(string)
+		delivery.ReplyTo, _ = props["reply_to"].(string)
+		delivery.Expiration, _ = props["expiration"].(string)
+		delivery.MessageId, _ = props["message_id"].(string)
+		delivery.Type, _ = props["type"].(string)
+		delivery.UserId, _ = props["user_id"].(string)
+		delivery.AppId, _ = props["app_id"].(string)
+		switch timestamp := props["timestamp"].(type) {
+		case time.Time:
+			delivery.Timestamp = timestamp
+		default:
+			if seconds := firehoseInt(timestamp); seconds > 0 {
+				delivery.Timestamp = time.Unix(seconds, 0)
+			}
+		}
+	}
+
+	data := map[string]interface{}{
+		"BodyAsString":   string(event.Body),
+		FirehoseEventKey: parts[0],
+	}
+	if node, ok := event.Headers["node"].(string); ok {
+		data[FirehoseNodeKey] = node
+	}
+	if parts[0] == "deliver" {
+		data[FirehoseQueueKey] = parts[1]
+	}
+
+	return &DeliveryPlus{delivery, data}, nil
+}
+
+func firehoseInt(value interface{}) int64 {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1
+		}
+	case byte:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package amqptools_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func TestDecodeFirehoseDeliverEvent(t *testing.T) {
+	timestamp := time.Unix(1380000000, 0)
+
+	event := amqp.Delivery{
+		Exchange:   amqptools.FirehoseExchange,
+		RoutingKey: "deliver.orders",
+		Body:       []byte(`{"id": 1}`),
+		Headers: amqp.Table{
+			"exchange_name": "events",
+			"routing_keys":  []interface{}{"order.created"},
+			"node":          "rabbit@localhost",
+			"redelivered":   int32(1),
+			"properties": amqp.Table{
+				"content_type":  "application/json",
+				"delivery_mode": int32(2),
+				"message_id":    "abc123",
+				"timestamp":     timestamp,
+				"headers":       amqp.Table{"x-tenant": "acme"},
+			},
+		},
+	}
+
+	delivery, err := amqptools.DecodeFirehose(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := delivery.RawDelivery
+	if d.Exchange != "events" || d.RoutingKey != "order.created" {
+		t.Errorf("unexpected routing %s/%s", d.Exchange, d.RoutingKey)
+	}
+	if d.ContentType != "application/json" || d.DeliveryMode != 2 || d.MessageId != "abc123" {
+		t.Errorf("unexpected properties %+v", d)
+	}
+	if !d.Timestamp.Equal(timestamp) || !d.Redelivered {
+		t.Errorf("unexpected timestamp or redelivered flag %+v", d)
+	}
+	if d.Headers["x-tenant"] != "acme" || string(d.Body) != `{"id": 1}` {
+		t.Errorf("unexpected headers or body %+v", d)
+	}
+
+	if delivery.Data[amqptools.FirehoseEventKey] != "deliver" ||
+		delivery.Data[amqptools.FirehoseNodeKey] != "rabbit@localhost" ||
+		delivery.Data[amqptools.FirehoseQueueKey] != "orders" {
+		t.Errorf("unexpected annotations %v", delivery.Data)
+	}
+}
+
+func TestDecodeFirehoseRejectsOtherMessages(t *testing.T) {
+	_, err := amqptools.DecodeFirehose(amqp.Delivery{RoutingKey: "order.created"})
+	if err == nil {
+		t.Error("expected an error for a message that is not a trace event")
+	}
+}
@@ -0,0 +1,188 @@
+package amqptools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// CompactFormat is the name of FormatSink's built-in one line per message
+// layout
+const CompactFormat = "compact"
+
+// compactBodyLength is how much of a body the compact layout shows
+const compactBodyLength = 120
+
+var ansiColors = map[string]string{
+	"bold":    "1",
+	"dim":     "2",
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+}
+
+// FormatSink writes each message to a stream for people to read, either laid
+// out by a text/template or as a single compact line with its timestamp,
+// exchange, routing key, short message id and the start of its body
+type FormatSink struct {
+	Writer io.Writer
+
+	template *template.Template
+	color    bool
+}
+
+// FormatContext is the data format templates are executed against, which is
+// that of message templates plus the body as rendered by RenderBody
+type FormatContext struct {
+	*TemplateContext
+	RenderedBody string
+}
+
+// NewFormatSink returns a sink writing messages in the given format, which is
+// CompactFormat or a template executed against a FormatContext.  Along with
+// TemplateFuncs, templates may use {{color "name" value}} to color text if
+// color is true and {{truncate n value}}.
+func NewFormatSink(w io.Writer, format string, color bool) (*FormatSink, error) {
+	s := &FormatSink{Writer: w, color: color}
+	if format == CompactFormat {
+		return s, nil
+	}
+
+	funcs := template.FuncMap{
+		"color":    s.colorize,
+		"truncate": truncate,
+	}
+	tmpl, err := template.New("format").Funcs(TemplateFuncs).Funcs(funcs).Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	s.template = tmpl
+	return s, nil
+}
+
+func (s *FormatSink) Write(delivery *DeliveryPlus) error {
+	var line string
+	if s.template == nil {
+		line = s.compactLine(delivery)
+	} else {
+		ctx := &FormatContext{NewTemplateContext(delivery), renderedBody(delivery)}
+
+		var err error
+		if line, err = executeTemplate(s.template, ctx); err != nil {
+			return err
+		}
+	}
+
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	_, err := io.WriteString(s.Writer, line)
+	return err
+}
+
+func (s *FormatSink) Close() error {
+	return nil
+}
+
+func (s *FormatSink) compactLine(delivery *DeliveryPlus) string {
+	d := delivery.RawDelivery
+
+	timestamp := d.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	exchange := d.Exchange
+	if len(exchange) == 0 {
+		exchange = "(default)"
+	}
+
+	id := d.MessageId
+	if len(id) == 0 {
+		id = "-"
+	} else if len(id) > 8 {
+		id = id[:8]
+	}
+
+	body := strings.Join(strings.Fields(renderedBody(delivery)), " ")
+
+	line := fmt.Sprintf("%s %s %s %s %s",
+		s.paint("dim", timestamp.Format("15:04:05.000")),
+		s.paint("cyan", exchange),
+		s.paint("yellow", d.RoutingKey),
+		s.paint("magenta", id),
+		truncate(compactBodyLength, body))
+	if d.Redelivered {
+		line += " " + s.paint("red", "(redelivered)")
+	}
+	return line
+}
+
+// colorize is the color template function, which refuses unknown colors
+// whether or not color is on so that a template works the same either way
+func (s *FormatSink) colorize(name string, value interface{}) (string, error) {
+	if _, ok := ansiColors[name]; !ok {
+		return "", fmt.Errorf("unknown color '%s'", name)
+	}
+	return s.paint(name, fmt.Sprint(value)), nil
+}
+
+// paint wraps text in an ANSI color, when color is on
+func (s *FormatSink) paint(name, text string) string {
+	if !s.color {
+		return text
+	}
+	return "\x1b[" + ansiColors[name] + "m" + text + "\x1b[0m"
+}
+
+// renderedBody returns the body as RenderBody left it in Data, or the raw
+// body with unprintable characters escaped if it has not been rendered
+func renderedBody(delivery *DeliveryPlus) string {
+	for _, key := range []string{"BodyAsJSON", "BodyAsString", "BodyAsBase64", "BodyAsHex"} {
+		switch value := delivery.Data[key].(type) {
+		case nil:
+		case string:
+			return value
+		default:
+			jsonBytes, _ := json.Marshal(value)
+			return string(jsonBytes)
+		}
+	}
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return r
+		}
+		return '.'
+	}, string(delivery.RawDelivery.Body))
+}
+
+// ColorTerminal reports whether a file is a terminal that should be written
+// in color, which it is not if the NO_COLOR environment variable is set
+func ColorTerminal(f *os.File) bool {
+	if len(os.Getenv("NO_COLOR")) > 0 || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// truncate shortens text to at most n characters, marking where it was cut
+func truncate(n int, value interface{}) string {
+	runes := []rune(fmt.Sprint(value))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	if n < 1 {
+		return ""
+	}
+	return string(runes[:n-1]) + "…"
+}
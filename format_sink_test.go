@@ -0,0 +1,105 @@
+package amqptools_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func TestFormatSinkCompact(t *testing.T) {
+	var buf bytes.Buffer
+	sink, err := amqptools.NewFormatSink(&buf, amqptools.CompactFormat, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := amqptools.NewDeliveryPlus("events", "order.created", amqp.Publishing{
+		MessageId: "0123456789abcdef",
+		Timestamp: time.Date(2013, 9, 24, 12, 30, 45, 0, time.UTC),
+		Body:      []byte("line one\nline two " + strings.Repeat("x", 200)),
+	})
+	if err = sink.Write(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	line := buf.String()
+	if !strings.HasPrefix(line, "12:30:45.000 events order.created 01234567 line one line two x") {
+		t.Errorf("unexpected line %q", line)
+	}
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "…\n") {
+		t.Errorf("expected a single truncated line, got %q", line)
+	}
+}
+
+func TestFormatSinkConcurrentWrites(t *testing.T) {
+	var buf bytes.Buffer
+	var mutex sync.Mutex
+	sink, err := amqptools.NewFormatSink(writerFunc(func(p []byte) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return buf.Write(p)
+	}), `{{.MessageId}}={{.RenderedBody}}`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			delivery := amqptools.NewDeliveryPlus("events", "order.created", amqp.Publishing{
+				MessageId: fmt.Sprint(i),
+				Body:      []byte(fmt.Sprint(i)),
+			})
+			if err := sink.Write(delivery); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 || parts[0] != parts[1] {
+			t.Errorf("message written with another message's body: %q", line)
+		}
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestFormatSinkTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	sink, err := amqptools.NewFormatSink(&buf, `{{color "red" .RoutingKey}} {{.RenderedBody}}`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := amqptools.NewDeliveryPlus("events", "order.created", amqp.Publishing{
+		ContentType: "application/json",
+		Body:        []byte(`{"id": 1}`),
+	})
+	amqptools.RenderBody(delivery, "auto")
+	if err = sink.Write(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "\x1b[31morder.created\x1b[0m {\"id\":1}\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	if _, err = amqptools.NewFormatSink(&buf, `{{.RoutingKey`, false); err == nil {
+		t.Error("expected an error for a broken template")
+	}
+}
@@ -0,0 +1,186 @@
+package amqptools
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// HTTPSink POSTs each message to a URL, as its JSON or, if Raw is true, as
+// its body with its properties in X-AMQP-* headers.  The message has been
+// handled once the server answers with a 2xx status.  A 4xx status rejects
+// the message with a RejectError, except for 408 and 429 which, like 5xx
+// statuses and failed requests, are retried up to Retries times, waiting
+// Backoff and then twice as long again each time, before the message is
+// requeued.
+type HTTPSink struct {
+	URL     string
+	Client  *http.Client
+	Raw     bool
+	Headers http.Header
+	Retries int
+	Backoff time.Duration
+}
+
+// NewHTTPSink returns a sink for a URL with a 30 second timeout and 3 retries
+// a second apart.  A user and password in the URL are sent as basic auth.
+func NewHTTPSink(rawURL string) (*HTTPSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &HTTPSink{
+		Client:  &http.Client{Timeout: 30 * time.Second},
+		Headers: make(http.Header),
+		Retries: 3,
+		Backoff: time.Second,
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		s.Headers.Set("Authorization", "Basic "+credentials)
+		u.User = nil
+	}
+	s.URL = u.String()
+	return s, nil
+}
+
+func (s *HTTPSink) Write(delivery *DeliveryPlus) error {
+	body, header, err := s.request(delivery)
+	if err != nil {
+		return err
+	}
+
+	backoff := s.Backoff
+	for attempt := 0; ; attempt++ {
+		err = s.post(body, header)
+		if _, rejected := err.(*RejectError); err == nil || rejected || attempt >= s.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// request builds the body and headers to POST for a message
+func (s *HTTPSink) request(delivery *DeliveryPlus) ([]byte, http.Header, error) {
+	header := make(http.Header)
+	for name, values := range s.Headers {
+		header[name] = values
+	}
+
+	if !s.Raw {
+		jsonBytes, err := MarshalDelivery(delivery, false)
+		header.Set("Content-Type", "application/json")
+		return jsonBytes, header, err
+	}
+
+	for name, values := range MessageHeaders(delivery.RawDelivery) {
+		header[name] = values
+	}
+	return delivery.RawDelivery.Body, header, nil
+}
+
+func (s *HTTPSink) post(body []byte, header http.Header) error {
+	request, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return &RejectError{err}
+	}
+	request.Header = header
+
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	// drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	status := response.StatusCode
+	switch {
+	case status >= 200 && status <= 299:
+		return nil
+	case status >= 400 && status <= 499 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests:
+		return &RejectError{fmt.Errorf("POST %s: %s", s.URL, response.Status)}
+	}
+	return fmt.Errorf("POST %s: %s", s.URL, response.Status)
+}
+
+func (s *HTTPSink) ConcurrentWrites() bool {
+	return true
+}
+
+func (s *HTTPSink) Close() error {
+	return nil
+}
+
+// MessageHeaders maps a message's properties to HTTP headers: Content-Type
+// and Content-Encoding as they are, the rest as X-AMQP-<property>, e.g.
+// X-AMQP-Routing-Key, and its headers as X-AMQP-Header-<name>
+func MessageHeaders(delivery amqp.Delivery) http.Header {
+	header := make(http.Header)
+	add := func(name, value string) {
+		if len(value) > 0 {
+			header.Set(name, value)
+		}
+	}
+
+	add("Content-Type", delivery.ContentType)
+	add("Content-Encoding", delivery.ContentEncoding)
+	add("X-AMQP-Exchange", delivery.Exchange)
+	add("X-AMQP-Routing-Key", delivery.RoutingKey)
+	add("X-AMQP-Redelivered", strconv.FormatBool(delivery.Redelivered))
+	if delivery.DeliveryMode > 0 {
+		add("X-AMQP-Delivery-Mode", strconv.Itoa(int(delivery.DeliveryMode)))
+	}
+	if delivery.Priority > 0 {
+		add("X-AMQP-Priority", strconv.Itoa(int(delivery.Priority)))
+	}
+	add("X-AMQP-Correlation-Id", delivery.CorrelationId)
+	add("X-AMQP-Reply-To", delivery.ReplyTo)
+	add("X-AMQP-Expiration", delivery.Expiration)
+	add("X-AMQP-Message-Id", delivery.MessageId)
+	if !delivery.Timestamp.IsZero() {
+		add("X-AMQP-Timestamp", delivery.Timestamp.UTC().Format(time.RFC3339))
+	}
+	add("X-AMQP-Type", delivery.Type)
+	add("X-AMQP-User-Id", delivery.UserId)
+	add("X-AMQP-App-Id", delivery.AppId)
+
+	for name, value := range delivery.Headers {
+		add("X-AMQP-Header-"+headerName(name), formatCell(value))
+	}
+	return header
+}
+
+// headerName replaces anything that can not be in an HTTP header name with a
+// hyphen
+func headerName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r > ' ' && r < 0x7f && !strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+func init() {
+	// http://... or https://..., POSTed to as they are
+	opener := func(u *url.URL) (Sink, error) {
+		return NewHTTPSink(u.String())
+	}
+	RegisterSink("http", opener)
+	RegisterSink("https", opener)
+}
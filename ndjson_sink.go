@@ -0,0 +1,403 @@
+package amqptools
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/klauspost/compress/zstd"
+)
+
+// NDJSONSink appends each message as a line of JSON to a series of files,
+// starting a new segment once the current one would grow past MaxSize bytes
+// of JSON, holds MaxMessages messages or has been open for MaxAge, whichever
+// comes first; zero disables a limit.  Segments are named after Path with a
+// sequence number before the extension, e.g. messages-000001.ndjson, and
+// existing segments are never overwritten.
+//
+// Each message is synced to disk before Write returns, so that nothing that
+// has been acknowledged can be lost.  Segments may be compressed with "gzip"
+// or "zstd", in which case the compressor is also flushed after every
+// message, which compresses each one on its own and much less well.  NoSync
+// leaves messages buffered until their segment is finished, compressing far
+// better and writing faster, at the risk of losing acknowledged messages if
+// the machine crashes.  Each finished segment is recorded in a manifest beside
+// them, e.g. messages.manifest.ndjson.
+type NDJSONSink struct {
+	Path        string
+	MaxSize     int64
+	MaxMessages int
+	MaxAge      time.Duration
+	Compression string
+	NoSync      bool
+
+	mutex    sync.Mutex
+	segment  *ndjsonSegment
+	sequence int
+	// err is a failure to close a segment that was rotated by MaxAge, which
+	// is reported by the next Write or Close
+	err error
+}
+
+// SegmentManifest describes a finished segment.  Timestamps are those of the
+// messages, and are left out if none of the messages had one.
+type SegmentManifest struct {
+	Segment           string     `json:"segment"`
+	Compression       string     `json:"compression,omitempty"`
+	Messages          int        `json:"messages"`
+	Bytes             int64      `json:"bytes"`
+	UncompressedBytes int64      `json:"uncompressed_bytes"`
+	SHA256            string     `json:"sha256"`
+	OpenedAt          time.Time  `json:"opened_at"`
+	ClosedAt          time.Time  `json:"closed_at"`
+	FirstTimestamp    *time.Time `json:"first_timestamp,omitempty"`
+	LastTimestamp     *time.Time `json:"last_timestamp,omitempty"`
+}
+
+type ndjsonSegment struct {
+	file       *os.File
+	compressor compressor
+	hash       hash.Hash
+	manifest   SegmentManifest
+	timer      *time.Timer
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Write passes everything written on to the file, and to the checksum
+func (seg *ndjsonSegment) Write(p []byte) (int, error) {
+	n, err := seg.file.Write(p)
+	seg.hash.Write(p[:n])
+	seg.manifest.Bytes += int64(n)
+	return n, err
+}
+
+var compressionExtensions = map[string]string{
+	"":     "",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// NewNDJSONSink returns a sink that will carry on from the last existing
+// segment number
+func NewNDJSONSink(path string, maxSize int64) (*NDJSONSink, error) {
+	s := &NDJSONSink{Path: path, MaxSize: maxSize}
+
+	matches, err := filepath.Glob(s.segmentPattern())
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		if n, ok := s.segmentNumber(match); ok && n > s.sequence {
+			s.sequence = n
+		}
+	}
+	return s, nil
+}
+
+func (s *NDJSONSink) stemAndExt() (string, string) {
+	ext := filepath.Ext(s.Path)
+	if len(ext) == 0 {
+		ext = ".ndjson"
+	}
+	return strings.TrimSuffix(s.Path, filepath.Ext(s.Path)), ext
+}
+
+// segmentPattern matches segments whatever they are compressed with
+func (s *NDJSONSink) segmentPattern() string {
+	stem, ext := s.stemAndExt()
+	return stem + "-*" + ext + "*"
+}
+
+func (s *NDJSONSink) segmentName(n int) string {
+	stem, ext := s.stemAndExt()
+	return fmt.Sprintf("%s-%06d%s%s", stem, n, ext, compressionExtensions[s.Compression])
+}
+
+func (s *NDJSONSink) segmentNumber(name string) (int, bool) {
+	stem, ext := s.stemAndExt()
+	number := strings.TrimPrefix(name, stem+"-")
+	if i := strings.Index(number, ext); i >= 0 {
+		number = number[:i]
+	}
+	n, err := strconv.Atoi(number)
+	return n, err == nil
+}
+
+// ManifestPath is where finished segments are recorded
+func (s *NDJSONSink) ManifestPath() string {
+	stem, _ := s.stemAndExt()
+	return stem + ".manifest.ndjson"
+}
+
+func (s *NDJSONSink) Write(delivery *DeliveryPlus) error {
+	jsonBytes, err := MarshalDelivery(delivery, false)
+	if err != nil {
+		return err
+	}
+	line := append(jsonBytes, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err = s.takeError(); err != nil {
+		return err
+	}
+
+	if seg := s.segment; seg != nil {
+		full := s.MaxSize > 0 && seg.manifest.UncompressedBytes > 0 &&
+			seg.manifest.UncompressedBytes+int64(len(line)) > s.MaxSize
+		if full || (s.MaxMessages > 0 && seg.manifest.Messages >= s.MaxMessages) {
+			if err = s.closeSegment(); err != nil {
+				return err
+			}
+		}
+	}
+	if s.segment == nil {
+		if err = s.openSegment(); err != nil {
+			return err
+		}
+	}
+
+	seg := s.segment
+	if seg.compressor != nil {
+		_, err = seg.compressor.Write(line)
+		if err == nil && !s.NoSync {
+			err = seg.compressor.Flush()
+		}
+	} else {
+		_, err = seg.Write(line)
+	}
+	if err == nil && !s.NoSync {
+		err = seg.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	seg.manifest.Messages++
+	seg.manifest.UncompressedBytes += int64(len(line))
+	if timestamp := delivery.RawDelivery.Timestamp; !timestamp.IsZero() {
+		if seg.manifest.FirstTimestamp == nil || timestamp.Before(*seg.manifest.FirstTimestamp) {
+			seg.manifest.FirstTimestamp = &timestamp
+		}
+		if seg.manifest.LastTimestamp == nil || timestamp.After(*seg.manifest.LastTimestamp) {
+			seg.manifest.LastTimestamp = &timestamp
+		}
+	}
+	return nil
+}
+
+func (s *NDJSONSink) takeError() error {
+	err := s.err
+	s.err = nil
+	return err
+}
+
+func (s *NDJSONSink) openSegment() error {
+	if _, ok := compressionExtensions[s.Compression]; !ok {
+		return fmt.Errorf("unknown compression '%s', expected gzip or zstd", s.Compression)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	// the manifest is there from the first segment on, so that ReadArchive
+	// finds segments that were never finished
+	manifest, err := os.OpenFile(s.ManifestPath(), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	manifest.Close()
+
+	s.sequence++
+	name := s.segmentName(s.sequence)
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if !s.NoSync {
+		// so that the new segment itself survives a crash
+		if err = syncDir(filepath.Dir(name)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	seg := &ndjsonSegment{
+		file: file,
+		hash: sha256.New(),
+		manifest: SegmentManifest{
+			Segment:     filepath.Base(name),
+			Compression: s.Compression,
+			OpenedAt:    time.Now().UTC(),
+		},
+	}
+
+	switch s.Compression {
+	case "gzip":
+		seg.compressor = gzip.NewWriter(seg)
+	case "zstd":
+		if seg.compressor, err = zstd.NewWriter(seg); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if s.MaxAge > 0 {
+		seg.timer = time.AfterFunc(s.MaxAge, func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.segment == seg {
+				s.err = s.closeSegment()
+			}
+		})
+	}
+
+	s.segment = seg
+	return nil
+}
+
+// closeSegment finishes the current segment, syncs it to disk and records it
+// in the manifest
+func (s *NDJSONSink) closeSegment() error {
+	seg := s.segment
+	s.segment = nil
+
+	if seg.timer != nil {
+		seg.timer.Stop()
+	}
+
+	var err error
+	if seg.compressor != nil {
+		err = seg.compressor.Close()
+	}
+	if syncErr := seg.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := seg.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	seg.manifest.ClosedAt = time.Now().UTC()
+	seg.manifest.SHA256 = fmt.Sprintf("%x", seg.hash.Sum(nil))
+	return s.appendManifest(seg.manifest)
+}
+
+func (s *NDJSONSink) appendManifest(entry SegmentManifest) error {
+	jsonBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.ManifestPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(jsonBytes, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *NDJSONSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.takeError()
+	if s.segment != nil {
+		if closeErr := s.closeSegment(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ParseByteSize parses a size in bytes with an optional K, M or G suffix, e.g.
+// "50M" or "50MB"
+func ParseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		number = number[:len(number)-1]
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return n * multiplier, nil
+}
+
+func init() {
+	// file:<path>[?max-size=100M&max-messages=10000&max-age=1h&compress=gzip|zstd&sync=false]
+	RegisterSink("file", func(u *url.URL) (Sink, error) {
+		query := u.Query()
+
+		var maxSize int64
+		if value := query.Get("max-size"); len(value) > 0 {
+			var err error
+			if maxSize, err = ParseByteSize(value); err != nil {
+				return nil, err
+			}
+		}
+
+		s, err := NewNDJSONSink(sinkPath(u), maxSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if value := query.Get("max-messages"); len(value) > 0 {
+			if s.MaxMessages, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("invalid max-messages '%s'", value)
+			}
+		}
+		if value := query.Get("max-age"); len(value) > 0 {
+			if s.MaxAge, err = time.ParseDuration(value); err != nil {
+				return nil, err
+			}
+		}
+		if value := query.Get("sync"); len(value) > 0 {
+			syncing, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sync '%s'", value)
+			}
+			s.NoSync = !syncing
+		}
+		s.Compression = query.Get("compress")
+		if _, ok := compressionExtensions[s.Compression]; !ok {
+			return nil, fmt.Errorf("unknown compression '%s', expected gzip or zstd", s.Compression)
+		}
+		return s, nil
+	})
+}
@@ -0,0 +1,148 @@
+package amqptools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// Plugin pipes messages through a long-running child process.
+//
+// The protocol is line based: for each message, a single line holding the
+// JSON-marshaled DeliveryPlus (the same format amqp-consume-cat prints) is
+// written to the child's stdin, with the body also available as
+// Data.BodyAsString.  The child must answer with a single line on stdout
+// holding a JSON object that is one of
+//
+//	{"messages": [<DeliveryPlus>, ...]}   zero or more messages to carry on with
+//	{"drop": true}                        discard the message
+//	{"error": "reason"}                   the message could not be handled
+//
+// When a returned message has a Data.BodyAsString string, it is used as the
+// body in preference to RawDelivery.Body so that plugins need not deal with
+// base64.  Returned headers are read back as a table, with whole numbers as
+// integers, so that they can be published.  Anything the child writes to
+// stderr is passed through.
+type Plugin struct {
+	Command string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	mutex  sync.Mutex
+}
+
+// PluginError is a per-message error verdict returned by a plugin.  Any other
+// error from Process means the plugin itself has failed.
+type PluginError struct {
+	Reason string
+}
+
+func (e *PluginError) Error() string {
+	return "plugin error: " + e.Reason
+}
+
+type pluginResponse struct {
+	Messages []*DeliveryPlus `json:"messages"`
+	Drop     bool            `json:"drop"`
+	Error    string          `json:"error"`
+}
+
+// StartPlugin starts a plugin command with sh -c.  It runs in its own process
+// group, so that a Ctrl-C in the terminal leaves it to finish the messages in
+// flight, and it exits once Close closes its stdin.
+func StartPlugin(command string) (*Plugin, error) {
+	p := &Plugin{Command: command}
+	p.cmd = exec.Command("sh", "-c", command)
+	p.cmd.Stderr = os.Stderr
+	p.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p.stdin = stdin
+	p.stdout = bufio.NewReader(stdout)
+	return p, nil
+}
+
+// Process hands a message to the plugin and returns the messages it sent
+// back.  A dropped message results in no messages and no error.
+func (p *Plugin) Process(delivery *DeliveryPlus) ([]*DeliveryPlus, error) {
+	request := *delivery
+	request.RawDelivery.Acknowledger = nil
+	request.Data = make(map[string]interface{})
+	for key, value := range delivery.Data {
+		request.Data[key] = value
+	}
+	request.Data["BodyAsString"] = string(delivery.RawDelivery.Body)
+
+	jsonBytes, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, err = p.stdin.Write(append(jsonBytes, '\n')); err != nil {
+		return nil, fmt.Errorf("plugin '%s' is not accepting messages: %s", p.Command, err)
+	}
+
+	line, err := p.stdout.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("plugin '%s' did not respond: %s", p.Command, err)
+	}
+
+	// numbers are kept exact so that headers can be converted back into a
+	// table that the broker accepts, with integers still integers
+	response := &pluginResponse{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err = decoder.Decode(response); err != nil {
+		return nil, fmt.Errorf("plugin '%s' sent an invalid response: %s", p.Command, err)
+	}
+
+	if len(response.Error) > 0 {
+		return nil, &PluginError{response.Error}
+	}
+	if response.Drop {
+		return nil, nil
+	}
+
+	messages := []*DeliveryPlus{}
+	for _, message := range response.Messages {
+		if message == nil {
+			continue
+		}
+		if message.Data == nil {
+			message.Data = make(map[string]interface{})
+		}
+		message.RawDelivery.Headers = TableFromJSON(message.RawDelivery.Headers)
+		if body, ok := message.Data["BodyAsString"].(string); ok {
+			message.RawDelivery.Body = []byte(body)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// Close closes the plugin's stdin and waits for it to exit
+func (p *Plugin) Close() error {
+	p.stdin.Close()
+	return p.cmd.Wait()
+}
@@ -0,0 +1,113 @@
+package amqptools_test
+
+import (
+	"testing"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+// respondingPlugin starts a plugin that answers every message with response
+func respondingPlugin(t *testing.T, response string) *amqptools.Plugin {
+	plugin, err := amqptools.StartPlugin(`while read line; do echo '` + response + `'; done`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plugin
+}
+
+func TestPluginMessages(t *testing.T) {
+	plugin := respondingPlugin(t, `{"messages": [`+
+		`{"RawDelivery": {"RoutingKey": "a"}, "Data": {"BodyAsString": "first"}},`+
+		`{"RawDelivery": {"RoutingKey": "b", "Body": "c2Vjb25k"}}]}`)
+	defer plugin.Close()
+
+	delivery := amqptools.NewDeliveryPlus("", "in", amqp.Publishing{Body: []byte("hello")})
+
+	for i := 0; i < 2; i++ {
+		messages, err := plugin.Process(delivery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 2 {
+			t.Fatalf("expected 2 messages, got %d", len(messages))
+		}
+		if messages[0].RawDelivery.RoutingKey != "a" || string(messages[0].RawDelivery.Body) != "first" {
+			t.Errorf("unexpected first message %+v", messages[0].RawDelivery)
+		}
+		if messages[1].RawDelivery.RoutingKey != "b" || string(messages[1].RawDelivery.Body) != "second" {
+			t.Errorf("unexpected second message %+v", messages[1].RawDelivery)
+		}
+	}
+}
+
+func TestPluginHeaders(t *testing.T) {
+	// echoes each message back unchanged
+	plugin, err := amqptools.StartPlugin(`while read line; do echo "{\"messages\": [$line]}"; done`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close()
+
+	delivery := amqptools.NewDeliveryPlus("", "in", amqp.Publishing{
+		Headers: amqp.Table{
+			"attempt": int32(3),
+			"x-death": []interface{}{amqp.Table{"count": int64(2), "queue": "orders"}},
+		},
+	})
+	messages, err := plugin.Process(delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+
+	headers := messages[0].RawDelivery.Headers
+	if err = messages[0].Publishing().Headers.Validate(); err != nil {
+		t.Fatalf("expected headers that can be published, got %s", err)
+	}
+	if headers["attempt"] != int64(3) {
+		t.Errorf("expected an integer header, got %#v", headers["attempt"])
+	}
+	deaths, _ := headers["x-death"].([]interface{})
+	if len(deaths) != 1 {
+		t.Fatalf("unexpected x-death %#v", headers["x-death"])
+	}
+	if death, ok := deaths[0].(amqp.Table); !ok || death["count"] != int64(2) || death["queue"] != "orders" {
+		t.Errorf("expected x-death to hold a table, got %#v", deaths[0])
+	}
+}
+
+func TestPluginDrop(t *testing.T) {
+	plugin := respondingPlugin(t, `{"drop": true}`)
+	defer plugin.Close()
+
+	messages, err := plugin.Process(amqptools.NewDeliveryPlus("", "in", amqp.Publishing{}))
+	if err != nil || len(messages) != 0 {
+		t.Errorf("expected the message to be dropped, got %v, %v", messages, err)
+	}
+}
+
+func TestPluginErrorVerdict(t *testing.T) {
+	plugin := respondingPlugin(t, `{"error": "bad tenant"}`)
+	defer plugin.Close()
+
+	_, err := plugin.Process(amqptools.NewDeliveryPlus("", "in", amqp.Publishing{}))
+	if pluginErr, ok := err.(*amqptools.PluginError); !ok || pluginErr.Reason != "bad tenant" {
+		t.Errorf("expected a plugin error, got %v", err)
+	}
+}
+
+func TestPluginExited(t *testing.T) {
+	plugin, err := amqptools.StartPlugin("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close()
+
+	_, err = plugin.Process(amqptools.NewDeliveryPlus("", "in", amqp.Publishing{}))
+	if _, ok := err.(*amqptools.PluginError); err == nil || ok {
+		t.Errorf("expected the plugin to have failed, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package amqptools
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// ForcedExitCode is what the tools exit with when a second signal cuts a
+// graceful shutdown short
+const ForcedExitCode = 99
+
+// Shutdown is asked for by SIGINT or SIGTERM.  C is closed by the first
+// signal so that work can wind down gracefully; a second signal exits at once
+// with ForcedExitCode.
+type Shutdown struct {
+	C <-chan struct{}
+
+	mutex   sync.Mutex
+	signal  os.Signal
+	signals chan os.Signal
+	stop    chan struct{}
+}
+
+// NotifyShutdown starts listening for SIGINT and SIGTERM
+func NotifyShutdown() *Shutdown {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	c := make(chan struct{})
+	s := &Shutdown{C: c, signals: signals, stop: make(chan struct{})}
+
+	go func() {
+		var sig os.Signal
+		select {
+		case sig = <-signals:
+		case <-s.stop:
+			return
+		}
+		s.mutex.Lock()
+		s.signal = sig
+		s.mutex.Unlock()
+		log.Printf("Received %s, shutting down (send it again to exit immediately)", sig)
+		close(c)
+
+		select {
+		case sig = <-signals:
+		case <-s.stop:
+			return
+		}
+		log.Printf("Received %s again, exiting immediately", sig)
+		os.Exit(ForcedExitCode)
+	}()
+	return s
+}
+
+// Stop stops listening for signals, which are then handled as they were
+// before NotifyShutdown was called
+func (s *Shutdown) Stop() {
+	signal.Stop(s.signals)
+	close(s.stop)
+}
+
+// Requested reports whether a signal has asked for a shutdown
+func (s *Shutdown) Requested() bool {
+	select {
+	case <-s.C:
+		return true
+	default:
+		return false
+	}
+}
+
+// ExitCode is what to exit with once the shutdown is complete, 128 plus the
+// signal number as shells report it, e.g. 130 for SIGINT, or 0 if no signal
+// was received
+func (s *Shutdown) ExitCode() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if sig, ok := s.signal.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return 0
+}
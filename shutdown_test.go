@@ -0,0 +1,29 @@
+package amqptools_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/modcloth/amqp-tools"
+)
+
+func TestShutdownOnSignal(t *testing.T) {
+	shutdown := amqptools.NotifyShutdown()
+	defer shutdown.Stop()
+	if shutdown.Requested() || shutdown.ExitCode() != 0 {
+		t.Fatal("expected no shutdown before a signal")
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	select {
+	case <-shutdown.C:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a shutdown after SIGTERM")
+	}
+	if !shutdown.Requested() || shutdown.ExitCode() != 143 {
+		t.Errorf("expected exit code 143, got %d", shutdown.ExitCode())
+	}
+}
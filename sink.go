@@ -0,0 +1,164 @@
+package amqptools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sink is a destination for consumed messages.  A message must only be
+// acknowledged once Write has returned without error, as that is when the
+// sink has confirmed that the message is safely written.
+type Sink interface {
+	Write(delivery *DeliveryPlus) error
+	Close() error
+}
+
+// ConcurrentSink is a Sink whose Write may be called from several goroutines
+// at once
+type ConcurrentSink interface {
+	Sink
+	ConcurrentWrites() bool
+}
+
+// RejectError is returned by a sink that has refused a message outright,
+// rather than failed to write it.  Such a message should be rejected without
+// being requeued, which dead-letters it if its queue has a DLX; any other
+// error from Write means the message should be requeued and tried again.
+type RejectError struct {
+	Err error
+}
+
+func (e *RejectError) Error() string {
+	return e.Err.Error()
+}
+
+// SinkOpener opens a sink from its URI
+type SinkOpener func(uri *url.URL) (Sink, error)
+
+var (
+	sinkOpeners = make(map[string]SinkOpener)
+	sinkMutex   sync.Mutex
+)
+
+// RegisterSink makes a sink available to OpenSink for URIs with the given
+// scheme
+func RegisterSink(scheme string, opener SinkOpener) {
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+	sinkOpeners[scheme] = opener
+}
+
+// SinkSchemes returns the URI schemes of every registered sink
+func SinkSchemes() []string {
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+
+	var schemes []string
+	for scheme := range sinkOpeners {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// OpenSink opens the sink named by a URI, e.g. "stdout:", "dir:/var/messages"
+// or "http://localhost:8080/messages".  "-" is short for "stdout:", and
+// everything after "exec:" is taken as it is, as it is a shell command.
+func OpenSink(uri string) (Sink, error) {
+	if uri == "-" {
+		uri = "stdout:"
+	}
+
+	var u *url.URL
+	if strings.HasPrefix(uri, "exec:") {
+		u = &url.URL{Scheme: "exec", Opaque: strings.TrimPrefix(uri, "exec:")}
+	} else {
+		var err error
+		if u, err = url.Parse(uri); err != nil {
+			return nil, err
+		}
+	}
+
+	sinkMutex.Lock()
+	opener, ok := sinkOpeners[u.Scheme]
+	sinkMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown sink '%s', expected one of: %s", uri, strings.Join(SinkSchemes(), ", "))
+	}
+	return opener(u)
+}
+
+// sinkPath returns the path of a sink URI, which may be written either as
+// "scheme:path" or "scheme://path"
+func sinkPath(u *url.URL) string {
+	if len(u.Opaque) > 0 {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+// MarshalDelivery marshals a delivery into JSON, indenting it if pretty is
+// true.  The delivery's Acknowledger is left out, as it can not be marshaled.
+func MarshalDelivery(delivery *DeliveryPlus, pretty bool) ([]byte, error) {
+	d := *delivery
+	d.RawDelivery.Acknowledger = nil
+
+	if pretty {
+		return json.MarshalIndent(&d, "", "\t")
+	}
+	return json.Marshal(&d)
+}
+
+// StreamSink writes each message as a line of JSON to a stream
+type StreamSink struct {
+	Writer io.Writer
+	Pretty bool
+}
+
+func (s *StreamSink) Write(delivery *DeliveryPlus) error {
+	jsonBytes, err := MarshalDelivery(delivery, s.Pretty)
+	if err != nil {
+		return err
+	}
+	_, err = s.Writer.Write(append(jsonBytes, '\n'))
+	return err
+}
+
+func (s *StreamSink) Close() error {
+	return nil
+}
+
+// NewStdoutSink returns a sink writing to stdout in the given format: "json"
+// or "" for JSON lines, "csv" or "tsv" with the given columns, or any other
+// format understood by NewFormatSink
+func NewStdoutSink(format string, pretty bool, columns string) (Sink, error) {
+	switch format {
+	case "", "json":
+		return &StreamSink{Writer: os.Stdout, Pretty: pretty}, nil
+	case "csv", "tsv":
+		if len(columns) == 0 {
+			columns = DefaultColumns
+		}
+		parsed, err := ParseColumns(columns)
+		if err != nil {
+			return nil, err
+		}
+		return NewTableSink(os.Stdout, format, parsed)
+	}
+	return NewFormatSink(os.Stdout, format, ColorTerminal(os.Stdout))
+}
+
+func init() {
+	// stdout:[?pretty=true|format=compact|format=<template>|format=csv&columns=...]
+	RegisterSink("stdout", func(u *url.URL) (Sink, error) {
+		query := u.Query()
+		return NewStdoutSink(query.Get("format"), query.Get("pretty") == "true", query.Get("columns"))
+	})
+}
@@ -0,0 +1,627 @@
+package amqptools_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func testDelivery(messageId, body string) *amqptools.DeliveryPlus {
+	return amqptools.NewDeliveryPlus("events", "order.created", amqp.Publishing{
+		MessageId: messageId,
+		Body:      []byte(body),
+	})
+}
+
+func TestStreamSinkWritesLines(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &amqptools.StreamSink{Writer: &buf}
+
+	for _, id := range []string{"a", "b"} {
+		if err := sink.Write(testDelivery(id, "{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"MessageId":"b"`) {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+}
+
+func TestDirectorySinkLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqptools-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := amqptools.OpenSink("dir:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Write(testDelivery("abc123", "{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "events", "abc123", "message.json")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDirectorySinkPathTemplateAndBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqptools-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pathTemplate, err := amqptools.NewTemplate("path", `{{.RoutingKey}}/{{.Timestamp.Format "2006-01-02"}}/{{.MessageId}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &amqptools.DirectorySink{Path: dir, PathTemplate: pathTemplate, ExtractBody: true}
+
+	delivery := testDelivery("abc123", `{"id": 1}`)
+	delivery.RawDelivery.ContentType = "application/json"
+	delivery.RawDelivery.Timestamp = time.Date(2013, 9, 24, 12, 0, 0, 0, time.UTC)
+	if err = sink.Write(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	messageDir := filepath.Join(dir, "order.created", "2013-09-24", "abc123")
+	body, err := ioutil.ReadFile(filepath.Join(messageDir, "body.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"id": 1}` {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	problems, err := amqptools.VerifyDirectory(dir, pathTemplate)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("expected a clean directory, got %v, %v", problems, err)
+	}
+
+	escape, _ := amqptools.NewTemplate("path", `../{{.MessageId}}`)
+	sink.PathTemplate = escape
+	if err = sink.Write(delivery); err == nil {
+		t.Error("expected a path outside the output directory to be refused")
+	}
+}
+
+func TestDirectorySinkEmptyPathComponents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqptools-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pathTemplate, err := amqptools.NewTemplate("path", `{{.Type}}/{{.MessageId}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &amqptools.DirectorySink{Path: dir, PathTemplate: pathTemplate}
+
+	for _, body := range []string{`{"n": 1}`, `{"n": 2}`} {
+		if err = sink.Write(testDelivery("", body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var messages []string
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == "message.json" {
+			messages = append(messages, name)
+		}
+		return err
+	})
+	if len(messages) != 2 {
+		t.Errorf("expected each message in its own directory, got %v", messages)
+	}
+
+	problems, err := amqptools.VerifyDirectory(dir, pathTemplate)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("expected a clean directory, got %v, %v", problems, err)
+	}
+}
+
+func TestVerifyDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqptools-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &amqptools.DirectorySink{Path: dir}
+	for _, id := range []string{"good", "truncated", ""} {
+		if err = sink.Write(testDelivery(id, "{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := amqptools.VerifyDirectory(dir, nil)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("expected a clean directory, got %v, %v", problems, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "events", "truncated", "message.json"), []byte(`{"RawDelivery": {`), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "events", "good", ".message.json.123.tmp"), []byte(`{`), 0666)
+
+	problems, err = amqptools.VerifyDirectory(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 {
+		t.Errorf("expected 2 problems, got %v", problems)
+	}
+}
+
+func TestReadArchiveHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqptools-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	delivery := testDelivery("dead", "{}")
+	delivery.RawDelivery.Headers = amqp.Table{
+		"attempt": int32(3),
+		"x-death": []interface{}{amqp.Table{"count": int64(2), "queue": "orders"}},
+	}
+	sink := &amqptools.DirectorySink{Path: dir}
+	if err = sink.Write(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	var read []*amqptools.DeliveryPlus
+	err = amqptools.ReadArchive(dir, func(delivery *amqptools.DeliveryPlus) error {
+		read = append(read, delivery)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(read))
+	}
+
+	headers := read[0].RawDelivery.Headers
+	if err = read[0].Publishing().Headers.Validate(); err != nil {
+		t.Fatalf("expected headers that can be republished, got %s", err)
+	}
+	if headers["attempt"] != int64(3) {
+		t.Errorf("expected an integer header, got %#v", headers["attempt"])
+	}
+	deaths, _ := headers["x-death"].([]interface{})
+	if len(deaths) != 1 {
+		t.Fatalf("unexpected x-death %#v", headers["x-death"])
+	}
+	if death, ok := deaths[0].(amqp.Table); !ok || death["count"] != int64(2) {
+		t.Errorf("expected x-death to hold a table, got %#v", deaths[0])
+	}
+}
+
+func TestReadArchiveSegmentNames(t *testing.T) {
+	for _, compress := range []string{"", "&compress=gzip"} {
+		dir, err := ioutil.TempDir("", "amqptools-sink")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// segments are named after the sink's path, e.g. msgs-000001.json.gz
+		sink, err := amqptools.OpenSink("file:" + filepath.Join(dir, "out", "msgs.json") + "?max-messages=2" + compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"a", "b", "c"} {
+			if err = sink.Write(testDelivery(id, "{}")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// an unfinished segment can only be read while it is uncompressed
+		if len(compress) > 0 {
+			sink.Close()
+		}
+
+		// unrelated files that look like segments are left alone
+		ioutil.WriteFile(filepath.Join(dir, "out", "notes-1.json"), []byte("not json"), 0666)
+
+		var ids []string
+		err = amqptools.ReadArchive(dir, func(delivery *amqptools.DeliveryPlus) error {
+			ids = append(ids, delivery.RawDelivery.MessageId)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(ids, ",") != "a,b,c" {
+			t.Errorf("%s: expected every segment to be read, got %v", compress, ids)
+		}
+		sink.Close()
+	}
+}
+
+func TestNDJSONSinkRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqptools-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := amqptools.OpenSink("file:" + filepath.Join(dir, "messages.ndjson") + "?max-size=400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = sink.Write(testDelivery("", strings.Repeat("x", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "messages-*.ndjson"))
+	if len(segments) != 3 {
+		t.Fatalf("expected 3 segments, got %v", segments)
+	}
+
+	// a new sink carries on after the existing segments
+	sink, err = amqptools.NewNDJSONSink(filepath.Join(dir, "messages.ndjson"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Write(testDelivery("", "{}")); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	if _, err = os.Stat(filepath.Join(dir, "messages-000004.ndjson")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNDJSONSinkCompressionAndManifest(t *testing.T) {
+	for _, compression := range []string{"gzip", "zstd"} {
+		dir, err := ioutil.TempDir("", "amqptools-sink")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "messages.ndjson")
+		sink, err := amqptools.OpenSink("file:" + path + "?max-messages=2&compress=" + compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			delivery := testDelivery("", "{}")
+			delivery.RawDelivery.Timestamp = time.Unix(int64(1380000000+i), 0).UTC()
+			if err = sink.Write(delivery); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		manifest, err := os.Open(filepath.Join(dir, "messages.manifest.ndjson"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []amqptools.SegmentManifest
+		decoder := json.NewDecoder(manifest)
+		for decoder.More() {
+			var entry amqptools.SegmentManifest
+			if err = decoder.Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		manifest.Close()
+
+		if len(entries) != 3 || entries[0].Messages != 2 || entries[2].Messages != 1 {
+			t.Fatalf("%s: unexpected manifest %+v", compression, entries)
+		}
+
+		first := entries[0]
+		if first.FirstTimestamp.Unix() != 1380000000 || first.LastTimestamp.Unix() != 1380000001 {
+			t.Errorf("%s: unexpected time range %s - %s", compression, first.FirstTimestamp, first.LastTimestamp)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, first.Segment))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checksum := fmt.Sprintf("%x", sha256.Sum256(data)); checksum != first.SHA256 {
+			t.Errorf("%s: checksum %s does not match manifest %s", compression, checksum, first.SHA256)
+		}
+		if compression == "gzip" {
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines, _ := ioutil.ReadAll(reader)
+			if n := strings.Count(string(lines), "\n"); n != 2 {
+				t.Errorf("expected 2 lines in %s, got %d", first.Segment, n)
+			}
+		}
+	}
+}
+
+// readSegments checks every segment in a manifest against its checksum and
+// count, and returns the messages read back out of them
+func readSegments(t *testing.T, dir string) ([]amqptools.SegmentManifest, []*amqptools.DeliveryPlus) {
+	manifest, err := os.Open(filepath.Join(dir, "messages.manifest.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+
+	var entries []amqptools.SegmentManifest
+	var messages []*amqptools.DeliveryPlus
+	decoder := json.NewDecoder(manifest)
+	for decoder.More() {
+		var entry amqptools.SegmentManifest
+		if err = decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+
+		name := filepath.Join(dir, entry.Segment)
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checksum := fmt.Sprintf("%x", sha256.Sum256(data)); checksum != entry.SHA256 {
+			t.Errorf("checksum of %s is %s, manifest has %s", entry.Segment, checksum, entry.SHA256)
+		}
+
+		count := 0
+		err = amqptools.ReadArchive(name, func(delivery *amqptools.DeliveryPlus) error {
+			count++
+			messages = append(messages, delivery)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unable to read %s: %s", entry.Segment, err)
+		}
+		if count != entry.Messages {
+			t.Errorf("read %d message(s) from %s, manifest has %d", count, entry.Segment, entry.Messages)
+		}
+	}
+	return entries, messages
+}
+
+func TestNDJSONSinkRotatesByCountAndAge(t *testing.T) {
+	for _, query := range []string{"max-messages=3", "max-messages=3&compress=zstd&sync=false", "max-age=50ms&compress=gzip"} {
+		dir, err := ioutil.TempDir("", "amqptools-sink")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		sink, err := amqptools.OpenSink("file:" + filepath.Join(dir, "messages.ndjson") + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 7; i++ {
+			if err = sink.Write(testDelivery(fmt.Sprint(i), "{}")); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(query, "max-age") && i == 3 {
+				time.Sleep(200 * time.Millisecond)
+			}
+		}
+		if err = sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, messages := readSegments(t, dir)
+		if strings.Contains(query, "max-age") {
+			if len(entries) != 2 || entries[0].Messages != 4 {
+				t.Errorf("%s: expected a segment rotated by age after 4 messages, got %+v", query, entries)
+			}
+		} else if len(entries) != 3 || entries[0].Messages != 3 || entries[2].Messages != 1 {
+			t.Errorf("%s: expected segments of 3, 3 and 1 messages, got %+v", query, entries)
+		}
+
+		if len(messages) != 7 {
+			t.Fatalf("%s: read back %d message(s)", query, len(messages))
+		}
+		for i, message := range messages {
+			if message.RawDelivery.MessageId != fmt.Sprint(i) {
+				t.Errorf("%s: message %d read back as '%s'", query, i, message.RawDelivery.MessageId)
+			}
+		}
+	}
+}
+
+func TestExecSinkExitStatus(t *testing.T) {
+	delivery := testDelivery("abc123", "hello")
+	delivery.RawDelivery.Headers = amqp.Table{"x-tenant": "acme"}
+
+	sink, err := amqptools.OpenSink(`exec:test "$(cat)/$AMQP_MESSAGE_ID/$AMQP_HEADER_X_TENANT" = hello/abc123/acme`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Write(delivery); err != nil {
+		t.Errorf("expected the body and environment to reach the command: %s", err)
+	}
+
+	sink, _ = amqptools.OpenSink("exec:exit 75")
+	if err = sink.Write(delivery); err == nil {
+		t.Error("expected an error asking for a requeue")
+	} else if _, ok := err.(*amqptools.RejectError); ok {
+		t.Errorf("expected a requeue rather than a rejection: %s", err)
+	}
+
+	sink, _ = amqptools.OpenSink("exec:exit 1")
+	if _, ok := sink.Write(delivery).(*amqptools.RejectError); !ok {
+		t.Error("expected a failing command to reject the message")
+	}
+
+	sink, _ = amqptools.OpenSink("exec:kill -9 $$")
+	if err = sink.Write(delivery); err == nil {
+		t.Error("expected a killed command to fail")
+	} else if _, ok := err.(*amqptools.RejectError); ok {
+		t.Errorf("expected a killed command to requeue rather than reject: %s", err)
+	}
+
+	// without a shell to run the command in, nothing can be started
+	sink, _ = amqptools.OpenSink("exec:true")
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "")
+	err = sink.Write(delivery)
+	os.Setenv("PATH", path)
+	if err == nil {
+		t.Error("expected a command that can not be started to fail")
+	} else if _, ok := err.(*amqptools.RejectError); ok {
+		t.Errorf("expected a failure to start to requeue rather than reject: %s", err)
+	}
+
+	sink, _ = amqptools.OpenSink("exec:sleep 10?timeout=100ms")
+	started := time.Now()
+	if _, ok := sink.Write(delivery).(*amqptools.RejectError); !ok {
+		t.Error("expected a timed out command to reject the message")
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Error("expected the command to be killed at its timeout")
+	}
+}
+
+func TestHTTPSinkStatuses(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusNoContent)
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/flaky":
+			if n%3 != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	delivery := testDelivery("a", "{}")
+	open := func(path string) *amqptools.HTTPSink {
+		sink, err := amqptools.NewHTTPSink(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.Retries = 2
+		sink.Backoff = time.Millisecond
+		atomic.StoreInt32(&attempts, 0)
+		return sink
+	}
+
+	if err := open("/ok").Write(delivery); err != nil {
+		t.Errorf("expected a 2xx to succeed: %s", err)
+	}
+
+	if _, ok := open("/bad").Write(delivery).(*amqptools.RejectError); !ok {
+		t.Error("expected a 4xx to reject the message")
+	}
+	if attempts != 1 {
+		t.Errorf("expected a 4xx not to be retried, got %d attempts", attempts)
+	}
+
+	if err := open("/flaky").Write(delivery); err != nil {
+		t.Errorf("expected a 5xx to be retried until it succeeds: %s", err)
+	}
+
+	err := open("/down").Write(delivery)
+	if err == nil {
+		t.Error("expected a persistent 5xx to fail")
+	} else if _, ok := err.(*amqptools.RejectError); ok {
+		t.Errorf("expected a requeue rather than a rejection: %s", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestHTTPSinkRawAndAuth(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	u.User = url.UserPassword("guest", "secret")
+	sink, err := amqptools.NewHTTPSink(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Raw = true
+	sink.Headers.Set("X-Api-Key", "k")
+
+	delivery := amqptools.NewDeliveryPlus("events", "order.created", amqp.Publishing{
+		MessageId:   "a",
+		ContentType: "text/plain",
+		Headers:     amqp.Table{"tenant id": "acme"},
+		Body:        []byte("hello"),
+	})
+	if err := sink.Write(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	if user, password, ok := request.BasicAuth(); !ok || user != "guest" || password != "secret" {
+		t.Errorf("expected basic auth, got %q", request.Header.Get("Authorization"))
+	}
+	if string(body) != "hello" {
+		t.Errorf("expected the raw body, got %q", body)
+	}
+	for name, expected := range map[string]string{
+		"Content-Type":            "text/plain",
+		"X-Amqp-Routing-Key":      "order.created",
+		"X-Amqp-Message-Id":       "a",
+		"X-Amqp-Header-Tenant-Id": "acme",
+		"X-Api-Key":               "k",
+	} {
+		if actual := request.Header.Get(name); actual != expected {
+			t.Errorf("expected %s: %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestOpenSinkUnknownScheme(t *testing.T) {
+	if _, err := amqptools.OpenSink("carrier-pigeon:coop"); err == nil {
+		t.Error("expected an error for an unknown sink")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for value, expected := range map[string]int64{"512": 512, "4K": 4096, "50MB": 50 << 20, "1g": 1 << 30} {
+		n, err := amqptools.ParseByteSize(value)
+		if err != nil || n != expected {
+			t.Errorf("ParseByteSize(%q) = %d, %v", value, n, err)
+		}
+	}
+}
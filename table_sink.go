@@ -0,0 +1,53 @@
+package amqptools
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+// TableSink writes each message as a row of comma or tab separated values,
+// after a header row naming the columns.  Rows are flushed as they are
+// written, so that the output can be followed while it is streamed.
+type TableSink struct {
+	Columns []Column
+
+	writer *csv.Writer
+}
+
+// NewTableSink writes the header row for a table in "csv" or "tsv" format
+func NewTableSink(w io.Writer, format string, columns []Column) (*TableSink, error) {
+	writer := csv.NewWriter(w)
+	switch format {
+	case "csv":
+	case "tsv":
+		writer.Comma = '\t'
+	default:
+		return nil, fmt.Errorf("unknown table format '%s', expected csv or tsv", format)
+	}
+
+	s := &TableSink{Columns: columns, writer: writer}
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	return s, s.writeRow(header)
+}
+
+func (s *TableSink) writeRow(cells []string) error {
+	if err := s.writer.Write(cells); err != nil {
+		return err
+	}
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+func (s *TableSink) Write(delivery *DeliveryPlus) error {
+	return s.writeRow(Values(s.Columns, delivery))
+}
+
+func (s *TableSink) Close() error {
+	s.writer.Flush()
+	return s.writer.Error()
+}
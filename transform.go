@@ -0,0 +1,306 @@
+package amqptools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+import (
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/streadway/amqp"
+)
+
+// Transformer rewrites a message before it is published
+type Transformer interface {
+	Transform(delivery *DeliveryPlus) error
+}
+
+// Transforms is a series of Transformers applied in order
+type Transforms []Transformer
+
+// Transform applies each transform in turn, stopping at the first error
+func (ts Transforms) Transform(delivery *DeliveryPlus) error {
+	for i, t := range ts {
+		if err := t.Transform(delivery); err != nil {
+			return fmt.Errorf("transform %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// JSONPatchTransform applies an RFC 6902 JSON Patch to the message body
+type JSONPatchTransform struct {
+	Patch jsonpatch.Patch
+}
+
+func (t *JSONPatchTransform) Transform(delivery *DeliveryPlus) error {
+	body, err := t.Patch.Apply(delivery.RawDelivery.Body)
+	if err != nil {
+		return err
+	}
+	delivery.RawDelivery.Body = body
+	return nil
+}
+
+// MergePatchTransform applies an RFC 7386 JSON merge patch to the message body
+type MergePatchTransform struct {
+	Patch []byte
+}
+
+func (t *MergePatchTransform) Transform(delivery *DeliveryPlus) error {
+	body, err := jsonpatch.MergePatch(delivery.RawDelivery.Body, t.Patch)
+	if err != nil {
+		return err
+	}
+	delivery.RawDelivery.Body = body
+	return nil
+}
+
+// TemplateTransform rewrites the message body and properties with Go
+// text/template templates executed against a TemplateContext.  Properties are
+// named as in amqp.Delivery, e.g. "MessageId", or "headers.<name>" for
+// individual headers.
+type TemplateTransform struct {
+	Body       *template.Template
+	Properties map[string]*template.Template
+}
+
+func (t *TemplateTransform) Transform(delivery *DeliveryPlus) error {
+	// every template sees the message as it was before this transform
+	ctx := NewTemplateContext(delivery)
+
+	if t.Body != nil {
+		body, err := executeTemplate(t.Body, ctx)
+		if err != nil {
+			return err
+		}
+		delivery.RawDelivery.Body = []byte(body)
+	}
+
+	for name, tmpl := range t.Properties {
+		value, err := executeTemplate(tmpl, ctx)
+		if err != nil {
+			return err
+		}
+		if err = SetProperty(&delivery.RawDelivery, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func executeTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// TemplateContext is the data made available to message templates.  The
+// delivery's fields may be referenced directly, e.g. {{.RoutingKey}}, and a
+// JSON body is available decoded as {{.JSON}}.
+type TemplateContext struct {
+	amqp.Delivery
+	Data map[string]interface{}
+	JSON interface{}
+}
+
+// NewTemplateContext builds the template data for a delivery
+func NewTemplateContext(delivery *DeliveryPlus) *TemplateContext {
+	ctx := &TemplateContext{Delivery: delivery.RawDelivery, Data: delivery.Data}
+	json.Unmarshal(delivery.RawDelivery.Body, &ctx.JSON)
+	return ctx
+}
+
+// BodyString returns the message body as a string
+func (ctx *TemplateContext) BodyString() string {
+	return string(ctx.Body)
+}
+
+// TemplateFuncs are the functions available to message templates
+var TemplateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		jsonBytes, err := json.Marshal(value)
+		return string(jsonBytes), err
+	},
+	"now": func() time.Time {
+		return time.Now().UTC()
+	},
+}
+
+// NewTemplate parses a message template with TemplateFuncs available
+func NewTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(TemplateFuncs).Parse(text)
+}
+
+var propertyNames = []string{
+	"Exchange", "RoutingKey", "ContentType", "ContentEncoding", "DeliveryMode",
+	"Priority", "CorrelationId", "ReplyTo", "Expiration", "MessageId",
+	"Timestamp", "Type", "UserId", "AppId",
+}
+
+// IsProperty reports whether name can be used with SetProperty
+func IsProperty(name string) bool {
+	if strings.HasPrefix(name, "headers.") {
+		return true
+	}
+	for _, propertyName := range propertyNames {
+		if name == propertyName {
+			return true
+		}
+	}
+	return false
+}
+
+// SetProperty sets a delivery property, or a header when the name has the
+// form "headers.<name>", from its string representation
+func SetProperty(delivery *amqp.Delivery, name, value string) error {
+	if strings.HasPrefix(name, "headers.") {
+		if delivery.Headers == nil {
+			delivery.Headers = amqp.Table{}
+		}
+		delivery.Headers[strings.TrimPrefix(name, "headers.")] = value
+		return nil
+	}
+
+	switch name {
+	case "Exchange":
+		delivery.Exchange = value
+	case "RoutingKey":
+		delivery.RoutingKey = value
+	case "ContentType":
+		delivery.ContentType = value
+	case "ContentEncoding":
+		delivery.ContentEncoding = value
+	case "CorrelationId":
+		delivery.CorrelationId = value
+	case "ReplyTo":
+		delivery.ReplyTo = value
+	case "Expiration":
+		delivery.Expiration = value
+	case "MessageId":
+		delivery.MessageId = value
+	case "Type":
+		delivery.Type = value
+	case "UserId":
+		delivery.UserId = value
+	case "AppId":
+		delivery.AppId = value
+	case "DeliveryMode", "Priority":
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid %s '%s': %s", name, value, err)
+		}
+		if name == "DeliveryMode" {
+			delivery.DeliveryMode = uint8(n)
+		} else {
+			delivery.Priority = uint8(n)
+		}
+	case "Timestamp":
+		timestamp, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid Timestamp '%s': %s", value, err)
+		}
+		delivery.Timestamp = timestamp
+	default:
+		return fmt.Errorf("unknown property '%s'", name)
+	}
+	return nil
+}
+
+// transformSpec is a single entry in a transform file.  Exactly one of its
+// fields must be set.
+type transformSpec struct {
+	JSONPatch  json.RawMessage `json:"json-patch"`
+	MergePatch json.RawMessage `json:"merge-patch"`
+	Template   *struct {
+		Body       *string           `json:"body"`
+		Properties map[string]string `json:"properties"`
+	} `json:"template"`
+}
+
+// ParseTransforms parses a JSON array of transforms, each an object with a
+// single "json-patch", "merge-patch" or "template" key, e.g.
+//
+//	[
+//	  {"json-patch": [{"op": "replace", "path": "/status", "value": "active"}]},
+//	  {"merge-patch": {"tenant_id": "acme"}},
+//	  {"template": {"properties": {"headers.x-tenant": "{{.JSON.tenant_id}}"}}}
+//	]
+func ParseTransforms(data []byte) (Transforms, error) {
+	var specs []transformSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, err
+	}
+
+	transforms := Transforms{}
+	for i, spec := range specs {
+		t, err := spec.transformer(i + 1)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d: %s", i+1, err)
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+// LoadTransforms reads transforms from a file in the format accepted by
+// ParseTransforms
+func LoadTransforms(filename string) (Transforms, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTransforms(data)
+}
+
+func (spec *transformSpec) transformer(index int) (Transformer, error) {
+	var found []Transformer
+
+	if spec.JSONPatch != nil {
+		patch, err := jsonpatch.DecodePatch(spec.JSONPatch)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, &JSONPatchTransform{patch})
+	}
+
+	if spec.MergePatch != nil {
+		found = append(found, &MergePatchTransform{spec.MergePatch})
+	}
+
+	if spec.Template != nil {
+		t := &TemplateTransform{Properties: map[string]*template.Template{}}
+		if spec.Template.Body != nil {
+			tmpl, err := NewTemplate(fmt.Sprintf("transform-%d-body", index), *spec.Template.Body)
+			if err != nil {
+				return nil, err
+			}
+			t.Body = tmpl
+		}
+		for name, text := range spec.Template.Properties {
+			if !IsProperty(name) {
+				return nil, fmt.Errorf("unknown property '%s'", name)
+			}
+			tmpl, err := NewTemplate(fmt.Sprintf("transform-%d-%s", index, name), text)
+			if err != nil {
+				return nil, err
+			}
+			t.Properties[name] = tmpl
+		}
+		found = append(found, t)
+	}
+
+	if len(found) != 1 {
+		return nil, errors.New("expected exactly one of json-patch, merge-patch or template")
+	}
+	return found[0], nil
+}
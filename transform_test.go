@@ -0,0 +1,95 @@
+package amqptools_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/modcloth/amqp-tools"
+	"github.com/streadway/amqp"
+)
+
+func transformedDelivery(t *testing.T, spec string, body string) *amqptools.DeliveryPlus {
+	transforms, err := amqptools.ParseTransforms([]byte(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := amqptools.NewDeliveryPlus("events", "order.created", amqp.Publishing{
+		MessageId: "abc123",
+		Body:      []byte(body),
+	})
+
+	if err = transforms.Transform(delivery); err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func bodyField(t *testing.T, delivery *amqptools.DeliveryPlus, field string) interface{} {
+	var body map[string]interface{}
+	if err := json.Unmarshal(delivery.RawDelivery.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body[field]
+}
+
+func TestJSONPatchTransform(t *testing.T) {
+	delivery := transformedDelivery(t,
+		`[{"json-patch": [{"op": "replace", "path": "/status", "value": "active"}]}]`,
+		`{"status": "ACTIVE"}`)
+
+	if bodyField(t, delivery, "status") != "active" {
+		t.Errorf("unexpected body %s", delivery.RawDelivery.Body)
+	}
+}
+
+func TestMergePatchTransform(t *testing.T) {
+	delivery := transformedDelivery(t,
+		`[{"merge-patch": {"tenant_id": "acme"}}]`,
+		`{"status": "active"}`)
+
+	if bodyField(t, delivery, "tenant_id") != "acme" || bodyField(t, delivery, "status") != "active" {
+		t.Errorf("unexpected body %s", delivery.RawDelivery.Body)
+	}
+}
+
+func TestTemplateTransform(t *testing.T) {
+	delivery := transformedDelivery(t,
+		`[{"template": {
+			"body": "{{.BodyString}}!",
+			"properties": {
+				"RoutingKey": "{{.RoutingKey}}.retry",
+				"Priority": "5",
+				"headers.x-tenant": "{{.JSON.tenant}}"
+			}
+		}}]`,
+		`{"tenant": "acme"}`)
+
+	d := delivery.RawDelivery
+	if string(d.Body) != `{"tenant": "acme"}!` {
+		t.Errorf("unexpected body %s", d.Body)
+	}
+	if d.RoutingKey != "order.created.retry" {
+		t.Errorf("unexpected routing key %s", d.RoutingKey)
+	}
+	if d.Priority != 5 {
+		t.Errorf("unexpected priority %d", d.Priority)
+	}
+	if d.Headers["x-tenant"] != "acme" {
+		t.Errorf("unexpected headers %v", d.Headers)
+	}
+}
+
+func TestParseTransformsRejectsAmbiguousEntries(t *testing.T) {
+	specs := []string{
+		`[{}]`,
+		`[{"merge-patch": {}, "json-patch": []}]`,
+		`[{"template": {"properties": {"Bogus": "x"}}}]`,
+	}
+
+	for _, spec := range specs {
+		if _, err := amqptools.ParseTransforms([]byte(spec)); err == nil {
+			t.Errorf("expected an error for %s", spec)
+		}
+	}
+}